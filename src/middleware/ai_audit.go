@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// contextKeyAudit holds the *auditor set by AIAuditMiddleware.
+const contextKeyAudit = "ai.audit"
+
+// Audit event types.
+const (
+	AuditAuth       = "auth"
+	AuditModelScope = "model_scope"
+	AuditQuotaCheck = "quota_check"
+	AuditQuotaDebit = "quota_debit"
+	AuditModeration = "moderation"
+)
+
+// Audit decisions.
+const (
+	AuditAllow  = "allow"
+	AuditDeny   = "deny"
+	AuditError  = "error"
+	AuditBypass = "bypass"
+)
+
+// AuditEvent is one security-relevant decision.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Decision  string    `json:"decision"`
+	RequestID string    `json:"request_id,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	// KeyID is a fingerprint of the API key, never the key itself.
+	KeyID  string `json:"key_id,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Tokens and Remaining are set on quota events.
+	Tokens    int64  `json:"tokens,omitempty"`
+	Remaining *int64 `json:"remaining,omitempty"`
+	// Categories are the moderation categories that blocked a prompt.
+	Categories []string `json:"categories,omitempty"`
+}
+
+// AuditSink stores audit events, ideally somewhere append-only and apart
+// from the operational logs.
+type AuditSink interface {
+	WriteAudit(ctx context.Context, ev AuditEvent) error
+}
+
+type auditor struct {
+	sink   AuditSink
+	logger *slog.Logger
+}
+
+// AIAuditMiddleware makes AIAuthMiddleware, AIQuotaMiddleware and
+// AIModerationMiddleware record their decisions to sink; register it before
+// them. A failed write is logged to logger (slog.Default when nil) and never
+// fails the request.
+func AIAuditMiddleware(sink AuditSink, logger *slog.Logger) gin.HandlerFunc {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	a := &auditor{sink: sink, logger: logger}
+
+	return func(c *gin.Context) {
+		c.Set(contextKeyAudit, a)
+		c.Next()
+	}
+}
+
+// audit records ev for c, filling in the time, request ID and tenant. It is
+// a no-op without AIAuditMiddleware.
+func audit(c *gin.Context, ev AuditEvent) {
+	v, ok := c.Get(contextKeyAudit)
+	if !ok {
+		return
+	}
+	a, ok := v.(*auditor)
+	if !ok {
+		return
+	}
+
+	ev.Time = time.Now().UTC()
+	ev.RequestID = RequestIDFromContext(c)
+	if ev.Tenant == "" {
+		ev.Tenant = c.GetString(ContextKeyTenant)
+	}
+	if err := a.sink.WriteAudit(context.WithoutCancel(c.Request.Context()), ev); err != nil {
+		a.logger.Error("audit write failed",
+			slog.String("type", ev.Type),
+			slog.String("decision", ev.Decision),
+			slog.String("request_id", ev.RequestID),
+			slog.String("error", err.Error()))
+	}
+}
+
+// auditKeyID fingerprints an API key for audit events.
+func auditKeyID(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// JSONAuditSink writes each event as a line of JSON to w, e.g. a file opened
+// with O_APPEND.
+type JSONAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{w: w}
+}
+
+func (s *JSONAuditSink) WriteAudit(_ context.Context, ev AuditEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(line)
+	return err
+}
@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrUnknownAPIKey is returned by KeyStore.Lookup when no key matches.
+var ErrUnknownAPIKey = errors.New("invalid API key")
+
+var errRevokedAPIKey = errors.New("API key has been revoked")
+
+// APIKeyRecord describes the tenant behind an API key.
+type APIKeyRecord struct {
+	Tenant string
+	// Tier is the tenant's plan, e.g. "free" or "paid".
+	Tier string
+	// Models lists the models the key may call. Empty allows all models.
+	Models  []string
+	Revoked bool
+}
+
+// AllowsModel reports whether the key may call model.
+func (r *APIKeyRecord) AllowsModel(model string) bool {
+	return len(r.Models) == 0 || slices.Contains(r.Models, model)
+}
+
+// KeyStore looks up API keys. Implementations should store only key hashes
+// (see HashAPIKey) and compare them in constant time.
+type KeyStore interface {
+	Lookup(ctx context.Context, apiKey string) (*APIKeyRecord, error)
+}
+
+// AIAuthMiddleware authenticates the bearer (or X-API-Key) API key and stores
+// its record under ContextKeyAPIKey and the tenant under ContextKeyTenant.
+// Unknown or revoked keys get 401; a model outside the key's scope, named in
+// the X-AI-Model header or the JSON body, gets 403.
+func AIAuthMiddleware(keys KeyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey := apiKeyFromRequest(c.Request)
+		if apiKey == "" {
+			audit(c, AuditEvent{Type: AuditAuth, Decision: AuditDeny, Reason: "missing_api_key"})
+			AbortWithAIError(c, http.StatusUnauthorized, ErrTypeAuth, "invalid_api_key", ErrUnknownAPIKey)
+			return
+		}
+		keyID := auditKeyID(apiKey)
+
+		record, err := keys.Lookup(c.Request.Context(), apiKey)
+		switch {
+		case errors.Is(err, ErrUnknownAPIKey):
+			audit(c, AuditEvent{Type: AuditAuth, Decision: AuditDeny, KeyID: keyID, Reason: "invalid_api_key"})
+			AbortWithAIError(c, http.StatusUnauthorized, ErrTypeAuth, "invalid_api_key", ErrUnknownAPIKey)
+			return
+		case err != nil:
+			_ = c.Error(err)
+			audit(c, AuditEvent{Type: AuditAuth, Decision: AuditError, KeyID: keyID, Reason: err.Error()})
+			AbortWithAIError(c, http.StatusInternalServerError, gin.ErrorTypePrivate, "", errors.New("authentication unavailable"))
+			return
+		case record.Revoked:
+			audit(c, AuditEvent{Type: AuditAuth, Decision: AuditDeny, Tenant: record.Tenant, KeyID: keyID, Reason: "revoked"})
+			AbortWithAIError(c, http.StatusUnauthorized, ErrTypeAuth, "invalid_api_key", errRevokedAPIKey)
+			return
+		}
+		audit(c, AuditEvent{Type: AuditAuth, Decision: AuditAllow, Tenant: record.Tenant, KeyID: keyID})
+
+		for _, model := range requestedModels(c) {
+			if !record.AllowsModel(model) {
+				audit(c, AuditEvent{Type: AuditModelScope, Decision: AuditDeny, Tenant: record.Tenant, KeyID: keyID, Model: model})
+				abortModelNotAllowed(c, model)
+				return
+			}
+			audit(c, AuditEvent{Type: AuditModelScope, Decision: AuditAllow, Tenant: record.Tenant, KeyID: keyID, Model: model})
+		}
+
+		c.Set(ContextKeyAPIKey, record)
+		c.Set(ContextKeyTenant, record.Tenant)
+		c.Next()
+	}
+}
+
+// requestedModels returns every model the request names: the one resolved by
+// DefaultModelResolver and the "model" field of a JSON body. Both are
+// checked, since the header and the body may disagree.
+func requestedModels(c *gin.Context) []string {
+	var models []string
+	if model := DefaultModelResolver(c); model != "" {
+		models = append(models, model)
+	}
+	if req, err := parseCompletionRequest(c); err == nil && req.Model != "" && !slices.Contains(models, req.Model) {
+		models = append(models, req.Model)
+	}
+	return models
+}
+
+func abortModelNotAllowed(c *gin.Context, model string) {
+	AbortWithAIError(c, http.StatusForbidden, ErrTypePermission, "model_not_allowed",
+		fmt.Errorf("API key may not use model %q", model))
+}
+
+// keyAllowsModel reports whether the key stored by AIAuthMiddleware may
+// call model. Requests without a key are not restricted. Middlewares that
+// rewrite ContextKeyModel after auth check the new model with it.
+func keyAllowsModel(c *gin.Context, model string) bool {
+	record, ok := APIKeyFromContext(c)
+	return !ok || record.AllowsModel(model)
+}
+
+// APIKeyFromContext returns the record stored by AIAuthMiddleware.
+func APIKeyFromContext(c *gin.Context) (*APIKeyRecord, bool) {
+	v, ok := c.Get(ContextKeyAPIKey)
+	if !ok {
+		return nil, false
+	}
+	record, ok := v.(*APIKeyRecord)
+	return record, ok
+}
+
+// HashAPIKey returns the SHA-256 hash under which a KeyStore keeps apiKey.
+func HashAPIKey(apiKey string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(apiKey))
+}
+
+// MemoryKeyStore is an in-process KeyStore for tests and static key sets.
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys []storedKey
+}
+
+type storedKey struct {
+	hash   [sha256.Size]byte
+	record *APIKeyRecord
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{}
+}
+
+// Add registers apiKey. Only its hash is kept.
+func (s *MemoryKeyStore) Add(apiKey string, record *APIKeyRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = append(s.keys, storedKey{hash: HashAPIKey(apiKey), record: record})
+}
+
+// Lookup compares against every stored hash, without returning early, so the
+// time taken does not reveal which key matched.
+func (s *MemoryKeyStore) Lookup(_ context.Context, apiKey string) (*APIKeyRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hash := HashAPIKey(apiKey)
+	var match *APIKeyRecord
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			match = k.record
+		}
+	}
+	if match == nil {
+		return nil, ErrUnknownAPIKey
+	}
+	return match, nil
+}
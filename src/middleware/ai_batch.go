@@ -0,0 +1,279 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Completer runs one completion request against a model provider.
+type Completer interface {
+	Complete(ctx context.Context, model string, request json.RawMessage) (*Completion, error)
+}
+
+// Completion is a provider response with its token usage.
+type Completion struct {
+	Body  json.RawMessage
+	Usage TokenUsage
+}
+
+// BatchOptions configures BatchHandler.
+type BatchOptions struct {
+	// Completer runs the items. Required.
+	Completer Completer
+	// Limiter bounds how many items run at once. Without it every item of
+	// a batch runs concurrently. It must not be the limiter of
+	// AIConcurrencyMiddleware on the batch route: the batch request holds a
+	// slot of that limiter while its items wait for more, so concurrent
+	// batches can take every slot and starve each other.
+	Limiter *ConcurrencyLimiter
+	// MaxBatchSize rejects larger batches with 413. Defaults to 20.
+	MaxBatchSize int
+	// Prices, if set, is used to record the aggregate ai_cost_usd.
+	Prices map[string]ModelPricing
+
+	// Moderation, InputLimit and RateLimit, if set, apply the checks of
+	// AIModerationMiddleware, AIInputLimitMiddleware and
+	// AIRateLimitMiddleware to every item, since those only see the batch
+	// as a whole. Pass the options given to the middlewares, with the same
+	// RateLimit.Limiter so items draw from the same buckets. Items naming a
+	// model outside the API key's scope are always rejected with 403.
+	Moderation *BatchModeration
+	InputLimit *InputLimitOptions
+	RateLimit  *RateLimitOptions
+}
+
+// BatchModeration is the classifier and options of AIModerationMiddleware.
+type BatchModeration struct {
+	Classifier ModerationClassifier
+	Options    ModerationOptions
+}
+
+// BatchResult is the outcome of one batch item.
+type BatchResult struct {
+	Index  int             `json:"index"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Usage  *batchUsage     `json:"usage,omitempty"`
+	Error  *APIError       `json:"error,omitempty"`
+}
+
+type batchUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// BatchHandler serves POST /ai/batch. The body is a JSON array of completion
+// requests; they run concurrently and the response lists one BatchResult per
+// item, in order, so partial failures are visible. The batch gets one span
+// under the request span of AIMetricsMiddleware, started with its Tracer,
+// with a child span per item, and its total token usage and cost are
+// recorded for AIMetricsMiddleware.
+func BatchHandler(opts BatchOptions) gin.HandlerFunc {
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = 20
+	}
+	if opts.RateLimit != nil && opts.RateLimit.Limiter == nil {
+		rateLimit := *opts.RateLimit
+		rateLimit.Limiter = NewMemoryRateLimiter()
+		opts.RateLimit = &rateLimit
+	}
+
+	return func(c *gin.Context) {
+		body, err := requestBody(c)
+		if abortBodyTooLarge(c, err) {
+			return
+		}
+		var items []json.RawMessage
+		if err == nil {
+			err = json.Unmarshal(body, &items)
+		}
+		if err != nil {
+			AbortWithAIError(c, http.StatusBadRequest, ErrTypeClient, "invalid_batch", err)
+			return
+		}
+		if len(items) > opts.MaxBatchSize {
+			AbortWithAIError(c, http.StatusRequestEntityTooLarge, ErrTypeClient, "batch_too_large",
+				fmt.Errorf("batch has %d items, the limit is %d", len(items), opts.MaxBatchSize))
+			return
+		}
+
+		ctx, span := startChildSpan(c.Request.Context(), "ai.batch")
+		span.SetTag("ai_batch_size", strconv.Itoa(len(items)))
+		defer span.Finish()
+
+		results := make([]BatchResult, len(items))
+		models := make([]string, len(items))
+		var wg sync.WaitGroup
+		for i, item := range items {
+			wg.Add(1)
+			go func(i int, item json.RawMessage) {
+				defer wg.Done()
+				models[i], results[i] = runBatchItem(ctx, c, opts, i, item)
+			}(i, item)
+		}
+		wg.Wait()
+
+		var (
+			total TokenUsage
+			cost  float64
+		)
+		for i, r := range results {
+			if r.Usage == nil {
+				continue
+			}
+			usage := TokenUsage{Prompt: r.Usage.PromptTokens, Completion: r.Usage.CompletionTokens}
+			total.Prompt += usage.Prompt
+			total.Completion += usage.Completion
+			if pricing, ok := lookupPricing(opts.Prices, models[i]); ok {
+				cost += pricing.Cost(usage)
+			}
+		}
+		c.Set(ContextKeyTokens, total)
+		SetAIExtra(c, "ai_batch_size", len(items))
+		if opts.Prices != nil {
+			c.Set(ContextKeyCostUSD, cost)
+			SetAIExtra(c, "ai_cost_usd", cost)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"results": results})
+	}
+}
+
+// runBatchItem checks and completes one item inside its own child span. It
+// runs on its own goroutine, out of reach of the recovery middlewares, so a
+// panic is recovered here and becomes a 500 result.
+func runBatchItem(ctx context.Context, c *gin.Context, opts BatchOptions, index int, item json.RawMessage) (model string, result BatchResult) {
+	ctx, span := startChildSpan(ctx, "ai.batch.item")
+	span.SetTag("ai_batch_index", strconv.Itoa(index))
+	defer func() {
+		if rec := recover(); rec != nil {
+			reportPanic(c, rec)
+			span.SetTag("ai_panic", "true")
+			result = batchError(index, http.StatusInternalServerError, APIErrorServer, errInternal)
+		}
+		span.SetExtra("ai_response_status", result.Status)
+		if result.Status >= http.StatusInternalServerError {
+			span.SetLevel(SpanLevelError)
+		}
+		span.Finish()
+	}()
+
+	var req completionRequest
+	if err := json.Unmarshal(item, &req); err != nil || req.Model == "" {
+		return "", batchError(index, http.StatusBadRequest, APIErrorInvalidRequest, errors.New("each item needs a model"))
+	}
+	model = req.Model
+	span.SetTag("ai_model", req.Model)
+
+	if rejected := checkBatchItem(ctx, c, opts, index, &req); rejected != nil {
+		return req.Model, *rejected
+	}
+
+	if opts.Limiter != nil {
+		if err := opts.Limiter.Acquire(ctx); err != nil {
+			return req.Model, batchError(index, http.StatusServiceUnavailable, APIErrorServer, errOverCapacity)
+		}
+		defer opts.Limiter.Release()
+	}
+
+	completion, err := opts.Completer.Complete(ctx, req.Model, item)
+	if err != nil {
+		status, errType := completionErrorStatus(err)
+		return req.Model, batchError(index, status, errType, err)
+	}
+
+	return req.Model, BatchResult{
+		Index:  index,
+		Status: http.StatusOK,
+		Body:   completion.Body,
+		Usage: &batchUsage{
+			PromptTokens:     completion.Usage.Prompt,
+			CompletionTokens: completion.Usage.Completion,
+			TotalTokens:      completion.Usage.Total(),
+		},
+	}
+}
+
+// checkBatchItem runs the checks a single request gets from the middlewares,
+// returning the result of a rejected item or nil.
+func checkBatchItem(ctx context.Context, c *gin.Context, opts BatchOptions, index int, req *completionRequest) *BatchResult {
+	record, ok := APIKeyFromContext(c)
+	if ok {
+		keyID := auditKeyID(apiKeyFromRequest(c.Request))
+		if !record.AllowsModel(req.Model) {
+			audit(c, AuditEvent{Type: AuditModelScope, Decision: AuditDeny, Tenant: record.Tenant, KeyID: keyID, Model: req.Model})
+			code := "model_not_allowed"
+			return batchRejected(index, http.StatusForbidden, APIError{
+				Message: fmt.Sprintf("API key may not use model %q", req.Model),
+				Type:    APIErrorPermission,
+				Code:    &code,
+			})
+		}
+		audit(c, AuditEvent{Type: AuditModelScope, Decision: AuditAllow, Tenant: record.Tenant, KeyID: keyID, Model: req.Model})
+	}
+
+	if opts.RateLimit != nil {
+		allowed, retryAfter, err := opts.RateLimit.allow(ctx, apiKeyFromRequest(c.Request), req.Model)
+		if err == nil && !allowed {
+			code := "rate_limit_exceeded"
+			return batchRejected(index, http.StatusTooManyRequests, APIError{
+				Message: errRateLimited.Error(),
+				Type:    APIErrorRateLimit,
+				Code:    &code,
+				Details: gin.H{"retry_after_seconds": int(math.Ceil(retryAfter.Seconds()))},
+			})
+		}
+	}
+
+	prompt := req.promptText()
+	if opts.InputLimit != nil {
+		if _, overLimit := opts.InputLimit.checkTokens(req.Model, prompt); overLimit != nil {
+			return batchRejected(index, http.StatusRequestEntityTooLarge, inputTooLargeAPIError(overLimit, overLimit.details()))
+		}
+	}
+
+	if m := opts.Moderation; m != nil && !m.Options.bypassed(c) {
+		// As in AIModerationMiddleware, a failing classifier lets the item through.
+		if flagged, err := moderate(ctx, m.Classifier, m.Options, prompt); err == nil && len(flagged) > 0 {
+			audit(c, AuditEvent{Type: AuditModeration, Decision: AuditDeny, Model: req.Model, Categories: flagged})
+			return batchRejected(index, http.StatusUnprocessableEntity, contentFlaggedError(flagged))
+		}
+	}
+	return nil
+}
+
+func batchRejected(index, status int, apiErr APIError) *BatchResult {
+	return &BatchResult{Index: index, Status: status, Error: &apiErr}
+}
+
+func batchError(index, status int, errType string, err error) BatchResult {
+	return BatchResult{
+		Index:  index,
+		Status: status,
+		Error:  &APIError{Message: err.Error(), Type: errType},
+	}
+}
+
+// completionErrorStatus maps a Completer error to an HTTP status and
+// OpenAI error type. A cancelled context means the client went away, which
+// is recorded as 499 as for single requests.
+func completionErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest, APIErrorInvalidRequest
+	case errors.Is(err, ErrCircuitOpen):
+		return http.StatusServiceUnavailable, APIErrorServer
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, APIErrorTimeout
+	}
+	return http.StatusBadGateway, APIErrorServer
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type completerFunc func(ctx context.Context, model string, request json.RawMessage) (*Completion, error)
+
+func (f completerFunc) Complete(ctx context.Context, model string, request json.RawMessage) (*Completion, error) {
+	return f(ctx, model, request)
+}
+
+// recordingTracer records the spans it starts and whether each child was
+// started under the request span.
+type recordingTracer struct {
+	mu       sync.Mutex
+	children map[string]int
+	orphans  int
+}
+
+type recordingSpanKey struct{}
+
+func (t *recordingTracer) StartSpan(r *http.Request, _ string, _ SpanOptions) (context.Context, Span) {
+	return context.WithValue(r.Context(), recordingSpanKey{}, true), nopSpan{}
+}
+
+func (t *recordingTracer) StartChild(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ctx.Value(recordingSpanKey{}) == nil {
+		t.orphans++
+	}
+	if t.children == nil {
+		t.children = map[string]int{}
+	}
+	t.children[name]++
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetTag(string, string) {}
+func (nopSpan) SetExtra(string, any)  {}
+func (nopSpan) SetLevel(SpanLevel)    {}
+func (nopSpan) Finish()               {}
+
+func TestBatchHandlerItems(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	completer := completerFunc(func(_ context.Context, model string, _ json.RawMessage) (*Completion, error) {
+		switch model {
+		case "panics":
+			panic("boom")
+		case "cancelled":
+			return nil, context.Canceled
+		}
+		return &Completion{Body: json.RawMessage(`{}`), Usage: TokenUsage{Prompt: 1, Completion: 1}}, nil
+	})
+	tracer := &recordingTracer{}
+	r := gin.New()
+	r.POST("/ai/batch", AIMetricsMiddleware(WithTracer(tracer)), BatchHandler(BatchOptions{Completer: completer}))
+
+	body := `[{"model":"gpt-4o"},{"model":"panics"},{"model":"cancelled"}]`
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ai/batch", strings.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var resp struct {
+		Results []BatchResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []int{http.StatusOK, http.StatusInternalServerError, statusClientClosedRequest}
+	if len(resp.Results) != len(want) {
+		t.Fatalf("%d results, want %d", len(resp.Results), len(want))
+	}
+	for i, status := range want {
+		if got := resp.Results[i].Status; got != status {
+			t.Errorf("item %d: status %d, want %d", i, got, status)
+		}
+	}
+
+	if tracer.children["ai.batch"] != 1 || tracer.children["ai.batch.item"] != len(want) {
+		t.Errorf("child spans %v, want one ai.batch and %d ai.batch.item", tracer.children, len(want))
+	}
+	if tracer.orphans > 0 {
+		t.Errorf("%d spans started outside the request span", tracer.orphans)
+	}
+}
@@ -0,0 +1,260 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrCircuitOpen is returned while the breaker for a provider is open.
+var ErrCircuitOpen = errors.New("model provider is unavailable, circuit breaker open")
+
+// BreakerState is the state of one circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// CircuitBreakerOptions configures AICircuitBreaker.
+type CircuitBreakerOptions struct {
+	// FailureThreshold is the number of consecutive failures that opens the
+	// breaker. Defaults to 5.
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before letting a probe
+	// request through. Defaults to 30s.
+	OpenTimeout time.Duration
+	// OnStateChange, if set, is called after every state transition.
+	OnStateChange func(key string, from, to BreakerState)
+}
+
+// AICircuitBreaker keeps one breaker per provider or model key. A breaker
+// opens after FailureThreshold consecutive failures, rejects calls while
+// open, then lets a single probe through; the probe's result closes or
+// reopens it.
+type AICircuitBreaker struct {
+	opts CircuitBreakerOptions
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+	now      func() time.Time
+}
+
+type breaker struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probeAt  time.Time
+}
+
+func NewAICircuitBreaker(opts CircuitBreakerOptions) *AICircuitBreaker {
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 5
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = 30 * time.Second
+	}
+	return &AICircuitBreaker{
+		opts:     opts,
+		breakers: make(map[string]*breaker),
+		now:      time.Now,
+	}
+}
+
+// State returns the current state of the breaker for key.
+func (b *AICircuitBreaker) State(key string) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if br, ok := b.breakers[key]; ok {
+		return br.state
+	}
+	return BreakerClosed
+}
+
+// States returns the state of every breaker that has seen traffic.
+func (b *AICircuitBreaker) States() map[string]BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	states := make(map[string]BreakerState, len(b.breakers))
+	for key, br := range b.breakers {
+		states[key] = br.state
+	}
+	return states
+}
+
+// Allow reports whether a call for key may proceed. In the half-open state
+// only one probe is let through per OpenTimeout.
+func (b *AICircuitBreaker) Allow(key string) bool {
+	b.mu.Lock()
+	br := b.breaker(key)
+	now := b.now()
+
+	var allowed bool
+	from := br.state
+	switch br.state {
+	case BreakerClosed:
+		allowed = true
+	case BreakerOpen:
+		if now.Sub(br.openedAt) >= b.opts.OpenTimeout {
+			br.state = BreakerHalfOpen
+			br.probeAt = now
+			allowed = true
+		}
+	case BreakerHalfOpen:
+		// A probe that never reported back must not wedge the breaker.
+		if now.Sub(br.probeAt) >= b.opts.OpenTimeout {
+			br.probeAt = now
+			allowed = true
+		}
+	}
+	to := br.state
+	b.mu.Unlock()
+
+	b.notify(key, from, to)
+	return allowed
+}
+
+// Record reports the result of a call allowed by Allow.
+func (b *AICircuitBreaker) Record(key string, success bool) {
+	b.mu.Lock()
+	br := b.breaker(key)
+	from := br.state
+	switch {
+	case success:
+		br.state = BreakerClosed
+		br.failures = 0
+	case br.state == BreakerHalfOpen:
+		br.state = BreakerOpen
+		br.openedAt = b.now()
+	default:
+		br.failures++
+		if br.failures >= b.opts.FailureThreshold {
+			br.state = BreakerOpen
+			br.openedAt = b.now()
+		}
+	}
+	to := br.state
+	b.mu.Unlock()
+
+	b.notify(key, from, to)
+}
+
+// breaker returns the breaker for key, creating it closed. b.mu must be held.
+func (b *AICircuitBreaker) breaker(key string) *breaker {
+	br, ok := b.breakers[key]
+	if !ok {
+		br = &breaker{}
+		b.breakers[key] = br
+	}
+	return br
+}
+
+func (b *AICircuitBreaker) notify(key string, from, to BreakerState) {
+	if from != to && b.opts.OnStateChange != nil {
+		b.opts.OnStateChange(key, from, to)
+	}
+}
+
+// Middleware rejects requests with 503 while the breaker for the request's
+// model is open. Upstream errors and timeouts count as failures; client
+// errors do not. keyFunc defaults to DefaultModelResolver.
+func (b *AICircuitBreaker) Middleware(keyFunc ModelResolver) gin.HandlerFunc {
+	if keyFunc == nil {
+		keyFunc = DefaultModelResolver
+	}
+
+	return func(c *gin.Context) {
+		key := keyFunc(c)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if !b.Allow(key) {
+			SetAITag(c, "ai_breaker_state", b.State(key).String())
+			AbortWithAIError(c, http.StatusServiceUnavailable, ErrTypeUpstream, "model_unavailable", ErrCircuitOpen)
+			return
+		}
+
+		c.Next()
+
+		switch classifyOutcome(c, c.Writer.Status()) {
+		case OutcomeClientDisconnected, OutcomeOverloaded:
+			// Says nothing about the provider either way.
+		case OutcomeUpstreamError, OutcomeTimeout:
+			b.Record(key, false)
+		default:
+			b.Record(key, true)
+		}
+		SetAITag(c, "ai_breaker_state", b.State(key).String())
+	}
+}
+
+// Transport wraps base so calls through an http.Client share the breaker.
+// keyFunc maps a request to its breaker key; it defaults to the host. 5xx
+// responses and transport errors count as failures, except for calls whose
+// context was cancelled. A nil base uses http.DefaultTransport.
+func (b *AICircuitBreaker) Transport(base http.RoundTripper, keyFunc func(*http.Request) string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if keyFunc == nil {
+		keyFunc = func(r *http.Request) string { return r.URL.Host }
+	}
+	return &breakerTransport{breaker: b, base: base, keyFunc: keyFunc}
+}
+
+type breakerTransport struct {
+	breaker *AICircuitBreaker
+	base    http.RoundTripper
+	keyFunc func(*http.Request) string
+}
+
+func (t *breakerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	key := t.keyFunc(r)
+	span := sentry.SpanFromContext(r.Context())
+
+	setState := func() {
+		if span == nil {
+			return
+		}
+		if value, ok := scrubberFromContext(r.Context()).tag("ai_breaker_state", t.breaker.State(key).String()); ok {
+			span.SetTag("ai_breaker_state", value)
+		}
+	}
+
+	if !t.breaker.Allow(key) {
+		setState()
+		return nil, ErrCircuitOpen
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		// The caller hung up, which says nothing about the provider. Expired
+		// deadlines still count, as timeouts do in Middleware.
+		setState()
+		return resp, err
+	}
+	t.breaker.Record(key, err == nil && resp.StatusCode < http.StatusInternalServerError)
+	setState()
+	return resp, err
+}
@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderAICache reports whether a response was served from the cache.
+const HeaderAICache = "X-AI-Cache"
+
+// defaultTemperature is what providers use when a request omits temperature.
+const defaultTemperature = 1.0
+
+// CacheStore stores completions by cache key.
+type CacheStore interface {
+	Get(ctx context.Context, key string) (*CachedResponse, bool, error)
+	Set(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration) error
+}
+
+// CacheKeyFunc derives the cache key of a request along with its sampling
+// temperature. ok is false for requests that cannot be cached.
+type CacheKeyFunc func(c *gin.Context) (key string, temperature float64, ok bool)
+
+// CacheOptions configures AICacheMiddleware.
+type CacheOptions struct {
+	// TTL is how long completions are kept. Defaults to 1h.
+	TTL time.Duration
+	// MaxTemperature is the highest temperature that is cached. Responses to
+	// hotter requests are meant to vary, so they always pass through.
+	MaxTemperature float64
+	// StaleTTL keeps completions this long past TTL, to be served only when
+	// the live path fails upstream. Zero disables stale serving.
+	StaleTTL time.Duration
+}
+
+// AICacheMiddleware serves repeated deterministic requests from store. Hits
+// get X-AI-Cache: hit and are tagged ai_cache=hit; misses are stored when the
+// handler answers 200 with a non-streamed body. keyFunc defaults to
+// PromptCacheKey.
+//
+// With StaleTTL set, an entry past TTL is kept in reserve while the request
+// goes to the live path; if that fails with an upstream error or timeout
+// (including an open breaker), the stale entry is served instead with
+// X-AI-Cache: stale and ai_outcome=served_stale. Register it before
+// AIFallbackMiddleware and AICircuitBreaker.Middleware so it only sees
+// failures that survived them.
+func AICacheMiddleware(store CacheStore, keyFunc CacheKeyFunc, opts CacheOptions) gin.HandlerFunc {
+	if keyFunc == nil {
+		keyFunc = PromptCacheKey
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = time.Hour
+	}
+
+	return func(c *gin.Context) {
+		key, temperature, ok := keyFunc(c)
+		if !ok || temperature > opts.MaxTemperature {
+			c.Next()
+			return
+		}
+
+		cached, hit, err := store.Get(c.Request.Context(), key)
+		if err != nil {
+			_ = c.Error(err)
+		}
+		var stale *CachedResponse
+		if hit && opts.StaleTTL > 0 && !cached.StoredAt.IsZero() && time.Since(cached.StoredAt) >= opts.TTL {
+			stale, hit = cached, false
+		}
+		if hit {
+			SetAITag(c, "ai_cache", "hit")
+			c.Header(HeaderAICache, "hit")
+			writeCachedResponse(c, cached)
+			return
+		}
+
+		SetAITag(c, "ai_cache", "miss")
+		c.Header(HeaderAICache, "miss")
+		orig := c.Writer
+		var held *fallbackWriter
+		if stale != nil {
+			// Hold back error responses until we know whether to replace them.
+			held = &fallbackWriter{ResponseWriter: orig, status: http.StatusOK}
+			c.Writer = held
+		}
+		baseHeader := orig.Header().Clone()
+		recorder := newBodyRecorder(c.Writer)
+		c.Writer = recorder
+		c.Next()
+		c.Writer = orig
+
+		if held != nil {
+			outcome := classifyOutcome(c, held.Status())
+			if held.passthrough || (outcome != OutcomeUpstreamError && outcome != OutcomeTimeout) {
+				held.release()
+			} else {
+				resetHeader(orig.Header(), baseHeader)
+				SetAITag(c, "ai_cache", "stale")
+				SetAIOutcome(c, OutcomeServedStale)
+				c.Header(HeaderAICache, "stale")
+				writeCachedResponse(c, stale)
+				return
+			}
+		}
+
+		if recorder.Status() != http.StatusOK || isEventStream(recorder.Header().Get("Content-Type")) {
+			return
+		}
+		resp := recorder.response()
+		resp.Header.Del(HeaderAICache)
+		resp.StoredAt = time.Now()
+		if err := store.Set(context.WithoutCancel(c.Request.Context()), key, resp, opts.TTL+opts.StaleTTL); err != nil {
+			_ = c.Error(err)
+		}
+	}
+}
+
+// PromptCacheKey hashes the model, whitespace-normalized prompt and
+// temperature of an OpenAI-style request body. Keys are scoped to the tenant
+// stored by AIAuthMiddleware, or to the caller's API key when it is not
+// set yet, so one tenant is never served another's completions.
+func PromptCacheKey(c *gin.Context) (string, float64, bool) {
+	req, err := parseCompletionRequest(c)
+	if err != nil {
+		return "", 0, false
+	}
+	temperature := defaultTemperature
+	if req.Temperature != nil {
+		temperature = *req.Temperature
+	}
+
+	scope := "key:" + apiKeyFromRequest(c.Request)
+	if tenant := c.GetString(ContextKeyTenant); tenant != "" {
+		scope = "tenant:" + tenant
+	}
+
+	h := sha256.New()
+	h.Write([]byte(scope))
+	h.Write([]byte{0})
+	h.Write([]byte(req.Model))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.Join(strings.Fields(req.promptText()), " ")))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatFloat(temperature, 'f', -1, 64)))
+	return hex.EncodeToString(h.Sum(nil)), temperature, true
+}
+
+// MemoryCacheStore is an in-process CacheStore for tests and single instance
+// deployments. Expired entries are swept once a minute, since keys are as
+// many as distinct prompts.
+type MemoryCacheStore struct {
+	mu        sync.Mutex
+	entries   map[string]cacheEntry
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+type cacheEntry struct {
+	resp    *CachedResponse
+	expires time.Time
+}
+
+func NewMemoryCacheStore() *MemoryCacheStore {
+	return &MemoryCacheStore{
+		entries: make(map[string]cacheEntry),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryCacheStore) Get(_ context.Context, key string) (*CachedResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if !s.now().Before(e.expires) {
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+	return e.resp, true, nil
+}
+
+func (s *MemoryCacheStore) Set(_ context.Context, key string, resp *CachedResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+	s.entries[key] = cacheEntry{resp: resp, expires: now.Add(ttl)}
+	return nil
+}
+
+// sweep drops expired entries, at most once per memorySweepInterval. The
+// caller holds s.mu.
+func (s *MemoryCacheStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < memorySweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPromptCacheKeyTenantScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys := NewMemoryKeyStore()
+	keys.Add("sk-acme", &APIKeyRecord{Tenant: "acme"})
+	keys.Add("sk-acme-2", &APIKeyRecord{Tenant: "acme"})
+	keys.Add("sk-globex", &APIKeyRecord{Tenant: "globex"})
+
+	r := gin.New()
+	r.POST("/ai/chat", AIAuthMiddleware(keys), AICacheMiddleware(NewMemoryCacheStore(), nil, CacheOptions{}), func(c *gin.Context) {
+		c.String(http.StatusOK, "completion for "+c.GetString(ContextKeyTenant))
+	})
+
+	tests := []struct {
+		apiKey string
+		want   string
+	}{
+		{apiKey: "sk-acme", want: "miss"},
+		{apiKey: "sk-acme-2", want: "hit"},
+		{apiKey: "sk-globex", want: "miss"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/ai/chat", strings.NewReader(`{"model":"gpt-4o","prompt":"hi","temperature":0}`))
+		req.Header.Set("Authorization", "Bearer "+tt.apiKey)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if got := w.Header().Get(HeaderAICache); got != tt.want {
+			t.Errorf("%s: X-AI-Cache = %q, want %q (body %q)", tt.apiKey, got, tt.want, w.Body)
+		}
+	}
+}
+
+func TestMemoryCacheStoreSweep(t *testing.T) {
+	s := NewMemoryCacheStore()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b", "c"} {
+		_ = s.Set(ctx, key, &CachedResponse{Status: http.StatusOK}, time.Second)
+	}
+	now = now.Add(memorySweepInterval)
+	_ = s.Set(ctx, "d", &CachedResponse{Status: http.StatusOK}, time.Hour)
+
+	if len(s.entries) != 1 {
+		t.Errorf("%d entries after the sweep, want 1", len(s.entries))
+	}
+}
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderCanaryToken carries the internal token that guards CanaryHandler.
+const HeaderCanaryToken = "X-Canary-Token"
+
+const defaultCanaryPrompt = "Reply with the single word OK."
+
+var errInvalidCanaryToken = errors.New("invalid canary token")
+
+// CanaryOptions configures CanaryHandler.
+type CanaryOptions struct {
+	// Token is the internal token expected in X-Canary-Token. Required; an
+	// empty Token rejects every probe.
+	Token string
+	// Handler serves the probe request, normally the gin engine that also
+	// serves tenant traffic, so the probe takes the real middleware chain.
+	// Required.
+	Handler http.Handler
+	// Path is the completion route the probe is sent to. Defaults to
+	// "/ai/chat".
+	Path string
+	// APIKey authenticates the probe like a tenant request.
+	APIKey string
+	// Model is the model the probe asks for.
+	Model string
+	// Prompt is the fixed, cheap prompt. Defaults to asking for "OK".
+	Prompt string
+	// Timeout bounds the probe. Defaults to 30s.
+	Timeout time.Duration
+}
+
+// canaryReport is the body served by CanaryHandler.
+type canaryReport struct {
+	Status         string    `json:"status"`
+	Stage          string    `json:"stage,omitempty"`
+	Model          string    `json:"model,omitempty"`
+	Route          string    `json:"route,omitempty"`
+	Outcome        string    `json:"outcome,omitempty"`
+	ResponseStatus int       `json:"response_status"`
+	DurationMs     int64     `json:"duration_ms"`
+	Error          *APIError `json:"error,omitempty"`
+}
+
+type syntheticKey struct{}
+
+// syntheticRequest marks a request sent through the engine by CanaryHandler
+// or ReplayHandler. AIMetricsMiddleware fills in how it went.
+type syntheticRequest struct {
+	replay  bool
+	model   string
+	route   string
+	outcome string
+}
+
+func (p *syntheticRequest) record(model, route, outcome string) {
+	p.model, p.route, p.outcome = model, route, outcome
+}
+
+func syntheticFromContext(ctx context.Context) *syntheticRequest {
+	probe, _ := ctx.Value(syntheticKey{}).(*syntheticRequest)
+	return probe
+}
+
+// isReplay reports whether c is a request re-run by ReplayHandler.
+func isReplay(c *gin.Context) bool {
+	probe := syntheticFromContext(c.Request.Context())
+	return probe != nil && probe.replay
+}
+
+// CanaryHandler serves /ai/canary for scheduled end-to-end checks. It sends
+// a fixed prompt through opts.Handler as an ordinary completion request, so
+// auth, routing and the model call all run for real, and answers with the
+// timing and result: 200 on success, 503 with the failed stage (auth,
+// admission, validation, routing or model) otherwise. Both the canary and
+// the probe spans are tagged ai_canary=true and neither is counted in the
+// Prometheus metrics.
+func CanaryHandler(opts CanaryOptions) gin.HandlerFunc {
+	if opts.Path == "" {
+		opts.Path = "/ai/chat"
+	}
+	if opts.Prompt == "" {
+		opts.Prompt = defaultCanaryPrompt
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+
+	return func(c *gin.Context) {
+		if !validInternalToken(c.GetHeader(HeaderCanaryToken), opts.Token) {
+			AbortWithAIError(c, http.StatusUnauthorized, ErrTypeAuth, "invalid_canary_token", errInvalidCanaryToken)
+			return
+		}
+		c.Set(ContextKeyCanary, true)
+
+		report, err := runCanary(c.Request.Context(), opts)
+		if err != nil {
+			_ = c.Error(err).SetType(ErrTypeUpstream)
+			SetAITag(c, "ai_canary_stage", report.Stage)
+			c.JSON(http.StatusServiceUnavailable, report)
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// validInternalToken compares got with want in constant time. An empty want
+// matches nothing.
+func validInternalToken(got, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// runCanary sends the probe and reports how it went. The error is non-nil
+// when the probe failed.
+func runCanary(ctx context.Context, opts CanaryOptions) (*canaryReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	probe := &syntheticRequest{}
+	ctx = context.WithValue(ctx, syntheticKey{}, probe)
+
+	body, err := json.Marshal(gin.H{
+		"model":    opts.Model,
+		"messages": []gin.H{{"role": "user", "content": opts.Prompt}},
+	})
+	if err != nil {
+		return &canaryReport{Status: "failed", Stage: "request"}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, opts.Path, bytes.NewReader(body))
+	if err != nil {
+		return &canaryReport{Status: "failed", Stage: "request"}, err
+	}
+	for key, values := range TraceHeadersFromContext(ctx) {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if opts.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.APIKey)
+	}
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	opts.Handler.ServeHTTP(rec, req)
+
+	report := &canaryReport{
+		Status:         "ok",
+		Model:          probe.model,
+		Route:          probe.route,
+		Outcome:        probe.outcome,
+		ResponseStatus: rec.Code,
+		DurationMs:     time.Since(start).Milliseconds(),
+	}
+	if rec.Code < http.StatusBadRequest {
+		return report, nil
+	}
+
+	report.Status = "failed"
+	report.Stage = canaryStage(rec.Code)
+	var envelope apiErrorEnvelope
+	if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err == nil && envelope.Error.Message != "" {
+		report.Error = &envelope.Error
+	}
+	return report, fmt.Errorf("canary failed at %s stage with status %d", report.Stage, rec.Code)
+}
+
+// canaryStage maps the status of a failed probe to the stage that failed.
+func canaryStage(status int) string {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "auth"
+	case http.StatusPaymentRequired, http.StatusTooManyRequests:
+		return "admission"
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return "validation"
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return "routing"
+	}
+	return "model"
+}
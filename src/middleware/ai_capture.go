@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"io"
+	"strings"
+)
+
+// truncatedMarker is appended to captured bodies that hit the size cap.
+const truncatedMarker = "...[truncated]"
+
+// Redactor rewrites a captured body before it leaves the process, e.g. to
+// strip PII or API keys.
+type Redactor func([]byte) []byte
+
+type bodyCapture struct {
+	maxBytes int
+	redactor Redactor
+}
+
+// WithBodyCapture attaches up to maxBytes of the request and response bodies,
+// and the allowlisted request headers, to the Sentry scope of failed
+// (4xx/5xx) requests. redactor, if non-nil, runs on each body before the
+// ScrubPolicy does. Streamed responses are never captured.
+func WithBodyCapture(maxBytes int, redactor Redactor) Option {
+	return func(cfg *metricsConfig) {
+		if maxBytes > 0 {
+			cfg.capture = &bodyCapture{maxBytes: maxBytes, redactor: redactor}
+		}
+	}
+}
+
+// cappedBuffer keeps the first max bytes written to it and drops the rest.
+type cappedBuffer struct {
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func newCappedBuffer(max int) *cappedBuffer {
+	return &cappedBuffer{max: max}
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	room := b.max - len(b.buf)
+	if len(p) > room {
+		b.buf = append(b.buf, p[:max(room, 0)]...)
+		b.truncated = true
+	} else {
+		b.buf = append(b.buf, p...)
+	}
+	return len(p), nil
+}
+
+// render returns the redacted and scrubbed contents, marked if they were
+// truncated.
+func (b *cappedBuffer) render(redactor Redactor, s *scrubber) string {
+	body := b.buf
+	if redactor != nil {
+		body = redactor(body)
+	}
+	rendered := s.body(string(body), b.truncated)
+	if b.truncated {
+		return rendered + truncatedMarker
+	}
+	return rendered
+}
+
+// captureReadCloser copies what the handler reads from the request body, so
+// the body is never read ahead of the handler.
+type captureReadCloser struct {
+	io.ReadCloser
+	buf *cappedBuffer
+}
+
+func (r *captureReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.Write(p[:n])
+	return n, err
+}
+
+// isEventStream reports whether contentType is a Server-Sent Events stream.
+func isEventStream(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/event-stream")
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContextKeyProviderClients holds the *ProviderClients set by its Middleware.
+const ContextKeyProviderClients = "ai.provider_clients"
+
+// ProviderClientOptions tunes the HTTP client of one provider. Zero fields
+// take the registry default, then the built-in one.
+type ProviderClientOptions struct {
+	// MaxIdleConnsPerHost is the keep-alive pool size per host.
+	// Defaults to 32.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps open connections per host. Defaults to no limit.
+	MaxConnsPerHost int
+	// IdleConnTimeout closes pooled connections idle this long.
+	// Defaults to 90s.
+	IdleConnTimeout time.Duration
+	// DialTimeout bounds connection setup. Defaults to 5s.
+	DialTimeout time.Duration
+	// KeepAlive is the TCP keep-alive period. Defaults to 30s.
+	KeepAlive time.Duration
+	// TLSHandshakeTimeout defaults to 10s.
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for the provider's response
+	// headers; slow models need more. Defaults to 60s.
+	ResponseHeaderTimeout time.Duration
+	// Timeout bounds the whole call, body included. Defaults to none, so
+	// streams are only bounded by the request context.
+	Timeout time.Duration
+}
+
+// TransportWrapper wraps the pooled transport of provider, e.g. with
+// AICircuitBreaker.Transport or NewTracingTransport.
+type TransportWrapper func(provider string, base http.RoundTripper) http.RoundTripper
+
+// ProviderClientsOptions configures NewProviderClients.
+type ProviderClientsOptions struct {
+	// Default applies to every provider.
+	Default ProviderClientOptions
+	// Providers overrides Default per provider name.
+	Providers map[string]ProviderClientOptions
+	// Wrap is applied to every transport in order, so the last wrapper is
+	// the outermost:
+	//
+	//	Wrap: []TransportWrapper{
+	//		func(_ string, rt http.RoundTripper) http.RoundTripper { return breaker.Transport(rt, nil) },
+	//		func(_ string, rt http.RoundTripper) http.RoundTripper { return NewTracingTransport(rt) },
+	//	}
+	Wrap []TransportWrapper
+}
+
+// ProviderClients hands out one shared, pooled http.Client per provider, so
+// provider calls reuse connections instead of paying a TLS handshake each.
+type ProviderClients struct {
+	opts ProviderClientsOptions
+
+	mu         sync.Mutex
+	clients    map[string]*http.Client
+	transports []*http.Transport
+}
+
+func NewProviderClients(opts ProviderClientsOptions) *ProviderClients {
+	return &ProviderClients{
+		opts:    opts,
+		clients: make(map[string]*http.Client),
+	}
+}
+
+// Client returns the client for provider, creating it on first use.
+func (p *ProviderClients) Client(provider string) *http.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if client, ok := p.clients[provider]; ok {
+		return client
+	}
+	opts := mergeClientOptions(p.opts.Providers[provider], p.opts.Default)
+	transport := newPooledTransport(opts)
+	var rt http.RoundTripper = transport
+	for _, wrap := range p.opts.Wrap {
+		rt = wrap(provider, rt)
+	}
+	client := &http.Client{Transport: rt, Timeout: opts.Timeout}
+	p.clients[provider] = client
+	p.transports = append(p.transports, transport)
+	return client
+}
+
+// CloseIdleConnections closes the idle connections of every client, e.g.
+// after Server.Shutdown.
+func (p *ProviderClients) CloseIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, transport := range p.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// Do sends req with provider's client under the request context of c, so
+// the provider call is cancelled as soon as the client disconnects or the
+// request deadline expires.
+func (p *ProviderClients) Do(c *gin.Context, provider string, req *http.Request) (*http.Response, error) {
+	return p.Client(provider).Do(req.WithContext(c.Request.Context()))
+}
+
+// Middleware stores p in the context for ProviderClientsFromContext.
+func (p *ProviderClients) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(ContextKeyProviderClients, p)
+		c.Next()
+	}
+}
+
+// ProviderClientsFromContext returns the registry set by
+// ProviderClients.Middleware, or nil.
+func ProviderClientsFromContext(c *gin.Context) *ProviderClients {
+	if v, ok := c.Get(ContextKeyProviderClients); ok {
+		if clients, ok := v.(*ProviderClients); ok {
+			return clients
+		}
+	}
+	return nil
+}
+
+// mergeClientOptions fills the zero fields of o from def, then from the
+// built-in defaults.
+func mergeClientOptions(o, def ProviderClientOptions) ProviderClientOptions {
+	pick := func(v, d, builtin time.Duration) time.Duration {
+		if v > 0 {
+			return v
+		}
+		if d > 0 {
+			return d
+		}
+		return builtin
+	}
+	pickInt := func(v, d, builtin int) int {
+		if v > 0 {
+			return v
+		}
+		if d > 0 {
+			return d
+		}
+		return builtin
+	}
+	return ProviderClientOptions{
+		MaxIdleConnsPerHost:   pickInt(o.MaxIdleConnsPerHost, def.MaxIdleConnsPerHost, 32),
+		MaxConnsPerHost:       pickInt(o.MaxConnsPerHost, def.MaxConnsPerHost, 0),
+		IdleConnTimeout:       pick(o.IdleConnTimeout, def.IdleConnTimeout, 90*time.Second),
+		DialTimeout:           pick(o.DialTimeout, def.DialTimeout, 5*time.Second),
+		KeepAlive:             pick(o.KeepAlive, def.KeepAlive, 30*time.Second),
+		TLSHandshakeTimeout:   pick(o.TLSHandshakeTimeout, def.TLSHandshakeTimeout, 10*time.Second),
+		ResponseHeaderTimeout: pick(o.ResponseHeaderTimeout, def.ResponseHeaderTimeout, 60*time.Second),
+		Timeout:               pick(o.Timeout, def.Timeout, 0),
+	}
+}
+
+func newPooledTransport(o ProviderClientOptions) *http.Transport {
+	dialer := &net.Dialer{Timeout: o.DialTimeout, KeepAlive: o.KeepAlive}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          o.MaxIdleConnsPerHost * 4,
+		MaxIdleConnsPerHost:   o.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       o.MaxConnsPerHost,
+		IdleConnTimeout:       o.IdleConnTimeout,
+		TLSHandshakeTimeout:   o.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: o.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
@@ -0,0 +1,251 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultCompressionMinSize = 1024
+
+// CompressionOptions configures AICompressionMiddleware.
+type CompressionOptions struct {
+	// MinSize is the smallest body that is compressed; smaller ones are
+	// sent as is. Defaults to 1KB.
+	MinSize int
+	// Level is the gzip/flate compression level. Zero or an invalid level
+	// means gzip.DefaultCompression.
+	Level int
+}
+
+// AICompressionMiddleware compresses responses with gzip or deflate, as
+// negotiated from Accept-Encoding. Bodies under MinSize, responses that set
+// their own Content-Encoding, already compressed media and event streams are
+// sent as is; a flush before MinSize is reached also sends the response
+// uncompressed, since compressing would hold back the flushed bytes.
+//
+// Register it before AIMetricsMiddleware so body capture and the SSE usage
+// scanner see the uncompressed response, and before AICacheMiddleware and
+// AIIdempotencyMiddleware so they store it.
+func AICompressionMiddleware(opts CompressionOptions) gin.HandlerFunc {
+	if opts.MinSize <= 0 {
+		opts.MinSize = defaultCompressionMinSize
+	}
+	if opts.Level == 0 || opts.Level < gzip.HuffmanOnly || opts.Level > gzip.BestCompression {
+		opts.Level = gzip.DefaultCompression
+	}
+	gzipPool := &sync.Pool{New: func() any {
+		zw, _ := gzip.NewWriterLevel(io.Discard, opts.Level)
+		return zw
+	}}
+	flatePool := &sync.Pool{New: func() any {
+		zw, _ := flate.NewWriter(io.Discard, opts.Level)
+		return zw
+	}}
+
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+
+		w := &compressWriter{
+			ResponseWriter: c.Writer,
+			encoding:       negotiateEncoding(c.GetHeader("Accept-Encoding")),
+			minSize:        opts.MinSize,
+			gzipPool:       gzipPool,
+			flatePool:      flatePool,
+		}
+		c.Writer = w
+		defer func() {
+			w.finish()
+			c.Writer = w.ResponseWriter
+		}()
+
+		c.Next()
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header, or
+// "" when the client accepts neither. Encodings with q=0 are not acceptable,
+// and "*" only stands for encodings the header does not name.
+func negotiateEncoding(header string) string {
+	qs := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		qs[name] = q
+	}
+
+	var best string
+	var bestQ float64
+	// gzip comes first so it wins ties: deflate is inconsistently
+	// implemented by clients.
+	for _, name := range []string{"gzip", "deflate"} {
+		q, ok := qs[name]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the start of the body until it knows whether the
+// response is worth compressing.
+type compressWriter struct {
+	gin.ResponseWriter
+
+	encoding  string
+	minSize   int
+	gzipPool  *sync.Pool
+	flatePool *sync.Pool
+
+	buf     bytes.Buffer
+	decided bool
+	size    int
+	zw      io.WriteCloser
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	w.size += len(b)
+	if w.decided {
+		return w.write(b)
+	}
+	w.buf.Write(b)
+	if w.buf.Len() >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) WriteHeaderNow() {
+	if !w.decided {
+		_ = w.decide(false)
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		_ = w.decide(false)
+	}
+	if f, ok := w.zw.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) Written() bool {
+	return w.decided || w.buf.Len() > 0
+}
+
+func (w *compressWriter) Size() int {
+	if !w.Written() {
+		return -1
+	}
+	return w.size
+}
+
+// decide commits the headers, compressed if compress is set and the
+// response is eligible, and sends the buffered bytes.
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	h := w.Header()
+	if compressible(w.Status(), h) {
+		h.Add("Vary", "Accept-Encoding")
+		if compress && w.encoding != "" {
+			h.Set("Content-Encoding", w.encoding)
+			h.Del("Content-Length")
+			w.zw = w.compressor()
+		}
+	}
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	_, err := w.write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+func (w *compressWriter) write(b []byte) (int, error) {
+	if w.zw != nil {
+		return w.zw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) compressor() io.WriteCloser {
+	if w.encoding == "gzip" {
+		zw := w.gzipPool.Get().(*gzip.Writer)
+		zw.Reset(w.ResponseWriter)
+		return zw
+	}
+	zw := w.flatePool.Get().(*flate.Writer)
+	zw.Reset(w.ResponseWriter)
+	return zw
+}
+
+// finish sends a body that stayed under MinSize and closes the compressor.
+func (w *compressWriter) finish() {
+	if !w.decided {
+		if w.buf.Len() == 0 {
+			return
+		}
+		_ = w.decide(false)
+	}
+	if w.zw == nil {
+		return
+	}
+	_ = w.zw.Close()
+	switch zw := w.zw.(type) {
+	case *gzip.Writer:
+		w.gzipPool.Put(zw)
+	case *flate.Writer:
+		w.flatePool.Put(zw)
+	}
+	w.zw = nil
+}
+
+// compressible reports whether a response may be compressed at all.
+func compressible(status int, h http.Header) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	if isEventStream(contentType) {
+		return false
+	}
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/octet-stream"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
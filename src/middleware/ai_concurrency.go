@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/semaphore"
+)
+
+var errOverCapacity = errors.New("server is at capacity, try again later")
+
+// ConcurrencyLimiter caps the number of in-flight AI requests.
+type ConcurrencyLimiter struct {
+	sem      *semaphore.Weighted
+	max      int64
+	wait     time.Duration
+	inFlight atomic.Int64
+	waiting  atomic.Int64
+	gauges   *limiterGauges
+}
+
+// limiterGauges are the collectors attached by AIMetrics.ObserveLimiter.
+type limiterGauges struct {
+	inFlight   prometheus.Gauge
+	queueDepth prometheus.Gauge
+	queueWait  prometheus.Observer
+}
+
+// NewConcurrencyLimiter allows max requests at once. Requests over the limit
+// wait up to wait for a slot.
+func NewConcurrencyLimiter(max int, wait time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		sem:  semaphore.NewWeighted(int64(max)),
+		max:  int64(max),
+		wait: wait,
+	}
+}
+
+// AIConcurrencyMiddleware limits in-flight requests to max, returning 503 to
+// requests that cannot get a slot within wait.
+func AIConcurrencyMiddleware(max int, wait time.Duration) gin.HandlerFunc {
+	return NewConcurrencyLimiter(max, wait).Middleware()
+}
+
+// Acquire takes a slot, waiting up to the limiter's wait timeout. It gives up
+// as soon as ctx is done, so an abandoned request never holds a slot.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) error {
+	if !l.sem.TryAcquire(1) {
+		if err := l.queue(ctx); err != nil {
+			return err
+		}
+	} else if l.gauges != nil {
+		l.gauges.queueWait.Observe(0)
+	}
+	l.inFlight.Add(1)
+	if l.gauges != nil {
+		l.gauges.inFlight.Inc()
+	}
+	return nil
+}
+
+// queue waits for a slot, counted in the queue depth meanwhile.
+func (l *ConcurrencyLimiter) queue(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, l.wait)
+	defer cancel()
+
+	start := time.Now()
+	l.waiting.Add(1)
+	if l.gauges != nil {
+		l.gauges.queueDepth.Inc()
+	}
+	err := l.sem.Acquire(ctx, 1)
+	l.waiting.Add(-1)
+	if l.gauges != nil {
+		l.gauges.queueDepth.Dec()
+		l.gauges.queueWait.Observe(time.Since(start).Seconds())
+	}
+	return err
+}
+
+// Release returns a slot taken by Acquire.
+func (l *ConcurrencyLimiter) Release() {
+	l.inFlight.Add(-1)
+	if l.gauges != nil {
+		l.gauges.inFlight.Dec()
+	}
+	l.sem.Release(1)
+}
+
+// InFlight returns the number of slots currently held.
+func (l *ConcurrencyLimiter) InFlight() int64 {
+	return l.inFlight.Load()
+}
+
+// Waiting returns the number of requests queued for a slot.
+func (l *ConcurrencyLimiter) Waiting() int64 {
+	return l.waiting.Load()
+}
+
+// Max returns the configured limit.
+func (l *ConcurrencyLimiter) Max() int64 {
+	return l.max
+}
+
+// Middleware holds a slot for the duration of each request.
+func (l *ConcurrencyLimiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := l.Acquire(c.Request.Context()); err != nil {
+			if c.Request.Context().Err() != nil {
+				// The client went away while waiting; nobody reads a response.
+				_ = c.Error(err)
+				c.Abort()
+				return
+			}
+			SetAIExtra(c, "ai_in_flight", l.InFlight())
+			c.Header("Retry-After", "1")
+			AbortWithAIError(c, http.StatusServiceUnavailable, ErrTypeOverload, "server_overloaded", errOverCapacity)
+			return
+		}
+		defer l.Release()
+
+		SetAIExtra(c, "ai_in_flight", l.InFlight())
+		c.Next()
+	}
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConcurrencyLimiterQueueDepthGauge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const (
+		limit    = 2
+		requests = 5
+	)
+	m := NewAIMetrics(prometheus.NewRegistry())
+	l := NewConcurrencyLimiter(limit, 5*time.Second)
+	m.ObserveLimiter("chat", l)
+	depth := m.QueueDepth.WithLabelValues("chat")
+	inFlight := m.InFlight.WithLabelValues("chat")
+
+	release := make(chan struct{})
+	r := gin.New()
+	r.POST("/ai/chat", l.Middleware(), func(c *gin.Context) {
+		<-release
+		c.Status(http.StatusOK)
+	})
+
+	var wg sync.WaitGroup
+	codes := make([]int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ai/chat", nil))
+			codes[i] = w.Code
+		}(i)
+	}
+
+	waitForGauge(t, depth, requests-limit)
+	if got := testutil.ToFloat64(inFlight); got != limit {
+		t.Fatalf("in-flight gauge = %v while queued, want %d", got, limit)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if got := testutil.ToFloat64(depth); got != 0 {
+		t.Errorf("queue depth gauge = %v after the queue drained, want 0", got)
+	}
+	if got := testutil.ToFloat64(inFlight); got != 0 {
+		t.Errorf("in-flight gauge = %v after all requests finished, want 0", got)
+	}
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d: status %d, want %d", i, code, http.StatusOK)
+		}
+	}
+}
+
+// waitForGauge polls g until it reads want, failing the test after a second.
+func waitForGauge(t *testing.T, g prometheus.Gauge, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := testutil.ToFloat64(g)
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth gauge = %v, want %v", got, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
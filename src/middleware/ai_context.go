@@ -0,0 +1,104 @@
+package middleware
+
+import "github.com/gin-gonic/gin"
+
+// Gin context keys shared by the AI middlewares. Handlers and upstream
+// middlewares set them with c.Set so AIMetricsMiddleware can read them back.
+const (
+	// ContextKeyModel holds the model name (string) chosen by the routing layer.
+	ContextKeyModel = "ai.model"
+	// ContextKeyProvider holds the name (string) of the provider that serves
+	// the request, set by the handler before it writes the response.
+	ContextKeyProvider = "ai.provider"
+	// ContextKeyRoute holds the name (string) of the routing rule that chose
+	// the model.
+	ContextKeyRoute = "ai.route"
+	// ContextKeyAPIKey holds the *APIKeyRecord set by AIAuthMiddleware.
+	ContextKeyAPIKey = "ai.api_key"
+	// ContextKeyTenant holds the tenant (string) of the authenticated key.
+	ContextKeyTenant = "ai.tenant"
+	// ContextKeyOutcome holds an ai_outcome (string) set with SetAIOutcome.
+	ContextKeyOutcome = "ai.outcome"
+	// ContextKeyClientDeadline is true when the request deadline came from
+	// the client's X-AI-Timeout-Ms header.
+	ContextKeyClientDeadline = "ai.client_deadline"
+	// ContextKeyRequestID holds the request ID (string).
+	ContextKeyRequestID = "ai.request_id"
+	// ContextKeyTags holds the extra Sentry tags (map[string]string) recorded
+	// with SetAITag.
+	ContextKeyTags = "ai.tags"
+	// ContextKeyExtras holds the extra Sentry extras (map[string]any)
+	// recorded with SetAIExtra.
+	ContextKeyExtras = "ai.extras"
+	// ContextKeyTokens holds the TokenUsage of the request once extracted.
+	ContextKeyTokens = "ai.tokens"
+	// ContextKeyCostUSD holds the estimated cost (float64) of the request.
+	ContextKeyCostUSD = "ai.cost_usd"
+	// ContextKeyCanary is true for synthetic requests sent by CanaryHandler,
+	// which are left out of the Prometheus metrics.
+	ContextKeyCanary = "ai.canary"
+)
+
+// TokenUsage is the number of tokens consumed by a request.
+type TokenUsage struct {
+	Prompt     int
+	Completion int
+}
+
+func (u TokenUsage) Total() int {
+	return u.Prompt + u.Completion
+}
+
+// SetAITag records a tag for AIMetricsMiddleware to attach to the request's
+// Sentry scope and span once the request completes.
+func SetAITag(c *gin.Context, key, value string) {
+	tags, _ := c.Get(ContextKeyTags)
+	m, ok := tags.(map[string]string)
+	if !ok {
+		m = make(map[string]string)
+		c.Set(ContextKeyTags, m)
+	}
+	m[key] = value
+}
+
+// SetAIExtra records an extra for AIMetricsMiddleware to attach to the
+// request's Sentry scope once the request completes.
+func SetAIExtra(c *gin.Context, key string, value any) {
+	extras, _ := c.Get(ContextKeyExtras)
+	m, ok := extras.(map[string]any)
+	if !ok {
+		m = make(map[string]any)
+		c.Set(ContextKeyExtras, m)
+	}
+	m[key] = value
+}
+
+// resolveTokens returns the token usage of c. The extractor runs at most once
+// per request; later callers reuse the value stored under ContextKeyTokens.
+func resolveTokens(c *gin.Context, extract TokenExtractor) (TokenUsage, bool) {
+	if v, ok := c.Get(ContextKeyTokens); ok {
+		usage, ok := v.(TokenUsage)
+		return usage, ok
+	}
+	prompt, completion, ok := extract(c)
+	if !ok {
+		return TokenUsage{}, false
+	}
+	usage := TokenUsage{Prompt: prompt, Completion: completion}
+	c.Set(ContextKeyTokens, usage)
+	return usage, true
+}
+
+// aiTags returns the tags recorded with SetAITag.
+func aiTags(c *gin.Context) map[string]string {
+	tags, _ := c.Get(ContextKeyTags)
+	m, _ := tags.(map[string]string)
+	return m
+}
+
+// aiExtras returns the extras recorded with SetAIExtra.
+func aiExtras(c *gin.Context) map[string]any {
+	extras, _ := c.Get(ContextKeyExtras)
+	m, _ := extras.(map[string]any)
+	return m
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import "github.com/gin-gonic/gin"
+
+// DefaultPricingKey is the price table entry used for unknown models.
+const DefaultPricingKey = "default"
+
+// ModelPricing is the USD price per 1000 tokens.
+type ModelPricing struct {
+	PromptPer1K     float64
+	CompletionPer1K float64
+}
+
+// Cost returns the USD cost of usage.
+func (p ModelPricing) Cost(usage TokenUsage) float64 {
+	return float64(usage.Prompt)/1000*p.PromptPer1K +
+		float64(usage.Completion)/1000*p.CompletionPer1K
+}
+
+// lookupPricing returns the pricing of model, or the DefaultPricingKey entry.
+func lookupPricing(prices map[string]ModelPricing, model string) (ModelPricing, bool) {
+	if pricing, ok := prices[model]; ok {
+		return pricing, true
+	}
+	pricing, ok := prices[DefaultPricingKey]
+	return pricing, ok
+}
+
+// CostOptions configures AICostMiddleware.
+type CostOptions struct {
+	// Prices maps model names to their pricing. The DefaultPricingKey entry,
+	// if any, prices models missing from the table.
+	Prices map[string]ModelPricing
+	// TokenExtractor defaults to HeaderTokenExtractor.
+	TokenExtractor TokenExtractor
+	// ModelResolver defaults to DefaultModelResolver.
+	ModelResolver ModelResolver
+}
+
+// AICostMiddleware estimates the cost of each request from its token usage
+// and records it as ai_cost_usd. It must be registered after
+// AIMetricsMiddleware so the metrics middleware can report the value.
+func AICostMiddleware(opts CostOptions) gin.HandlerFunc {
+	if opts.TokenExtractor == nil {
+		opts.TokenExtractor = HeaderTokenExtractor
+	}
+	if opts.ModelResolver == nil {
+		opts.ModelResolver = DefaultModelResolver
+	}
+
+	return func(c *gin.Context) {
+		c.Next()
+
+		// Token counts are only known once the response has been written.
+		usage, ok := resolveTokens(c, opts.TokenExtractor)
+		if !ok {
+			return
+		}
+		pricing, ok := lookupPricing(opts.Prices, opts.ModelResolver(c))
+		if !ok {
+			return
+		}
+
+		cost := pricing.Cost(usage)
+		c.Set(ContextKeyCostUSD, cost)
+		SetAIExtra(c, "ai_cost_usd", cost)
+	}
+}
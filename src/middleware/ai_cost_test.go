@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAICostMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	prices := map[string]ModelPricing{
+		"gpt-4o":          {PromptPer1K: 0.0025, CompletionPer1K: 0.01},
+		DefaultPricingKey: {PromptPer1K: 0.001, CompletionPer1K: 0.002},
+	}
+	tests := []struct {
+		model      string
+		prompt     int
+		completion int
+		wantMicros float64
+	}{
+		// 1200 * $0.0025/1K + 350 * $0.01/1K = $0.0065.
+		{model: "gpt-4o", prompt: 1200, completion: 350, wantMicros: 6500},
+		// Unknown models are priced by the default entry.
+		{model: "unlisted", prompt: 1000, completion: 500, wantMicros: 2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			var cost any
+			r := gin.New()
+			r.Use(func(c *gin.Context) {
+				c.Next()
+				cost, _ = c.Get(ContextKeyCostUSD)
+			})
+			r.POST("/ai/chat", AICostMiddleware(CostOptions{Prices: prices}), func(c *gin.Context) {
+				c.Header(HeaderTokensPrompt, strconv.Itoa(tt.prompt))
+				c.Header(HeaderTokensCompletion, strconv.Itoa(tt.completion))
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/ai/chat", nil)
+			req.Header.Set(HeaderModel, tt.model)
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			usd, ok := cost.(float64)
+			if !ok {
+				t.Fatalf("ai_cost_usd not recorded, got %v", cost)
+			}
+			if micros := usd * 1e6; math.Abs(micros-tt.wantMicros) > 1e-6 {
+				t.Errorf("cost = %v micro-dollars, want %v", micros, tt.wantMicros)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deadLetterMaxBody caps the request body kept for a dead letter when body
+// capture is not configured.
+const deadLetterMaxBody = 1 << 20
+
+// DeadLetter is a request that failed after part of its response had
+// already been streamed to the client.
+type DeadLetter struct {
+	ID     string
+	Time   time.Time
+	Method string
+	Path   string
+	Route  string
+	// Header excludes credentials.
+	Header        http.Header
+	Body          []byte
+	BodyTruncated bool
+	Model         string
+	Tenant        string
+	BytesStreamed int
+	Error         string
+}
+
+// DeadLetterSink receives failed-mid-stream requests for inspection or
+// replay.
+type DeadLetterSink interface {
+	Store(ctx context.Context, letter DeadLetter) error
+}
+
+// ErrDeadLetterNotFound is returned by DeadLetterStore.Load for unknown IDs.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetterStore is a DeadLetterSink that can read letters back, as needed
+// by ReplayHandler.
+type DeadLetterStore interface {
+	DeadLetterSink
+	Load(ctx context.Context, id string) (DeadLetter, error)
+}
+
+// WithDeadLetterSink sends requests that fail after streaming began to sink.
+// Such requests are tagged ai_outcome=partial_failure.
+func WithDeadLetterSink(sink DeadLetterSink) Option {
+	return func(cfg *metricsConfig) {
+		cfg.deadLetter = sink
+	}
+}
+
+// newDeadLetter builds the dead letter for c. body is the captured request
+// body, if any.
+func newDeadLetter(c *gin.Context, body *cappedBuffer, streamed int, model string) DeadLetter {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+
+	letter := DeadLetter{
+		ID:            hex.EncodeToString(id),
+		Time:          time.Now(),
+		Method:        c.Request.Method,
+		Path:          c.Request.URL.RequestURI(),
+		Route:         c.FullPath(),
+		Header:        withoutSecretHeaders(c.Request.Header),
+		Model:         model,
+		Tenant:        c.GetString(ContextKeyTenant),
+		BytesStreamed: streamed,
+		Error:         c.Errors.String(),
+	}
+	if body != nil {
+		letter.Body = body.buf
+		letter.BodyTruncated = body.truncated
+	}
+	return letter
+}
+
+// storeDeadLetter hands letter to sink once the client request is over.
+func storeDeadLetter(c *gin.Context, sink DeadLetterSink, letter DeadLetter) {
+	if err := sink.Store(context.WithoutCancel(c.Request.Context()), letter); err != nil {
+		SetAIExtra(c, "ai_dead_letter_error", err.Error())
+		return
+	}
+	SetAIExtra(c, "ai_dead_letter_id", letter.ID)
+}
+
+// MemoryDeadLetterStore is an in-process DeadLetterStore for tests and
+// single instance deployments. It keeps at most max letters, dropping the
+// oldest.
+type MemoryDeadLetterStore struct {
+	mu      sync.Mutex
+	max     int
+	order   []string
+	letters map[string]DeadLetter
+}
+
+func NewMemoryDeadLetterStore(max int) *MemoryDeadLetterStore {
+	return &MemoryDeadLetterStore{
+		max:     max,
+		letters: make(map[string]DeadLetter),
+	}
+}
+
+func (s *MemoryDeadLetterStore) Store(_ context.Context, letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.letters[letter.ID]; !ok {
+		s.order = append(s.order, letter.ID)
+	}
+	s.letters[letter.ID] = letter
+	for s.max > 0 && len(s.order) > s.max {
+		delete(s.letters, s.order[0])
+		s.order = s.order[1:]
+	}
+	return nil
+}
+
+func (s *MemoryDeadLetterStore) Load(_ context.Context, id string) (DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letter, ok := s.letters[id]
+	if !ok {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return letter, nil
+}
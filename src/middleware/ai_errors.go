@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// More error type markers, for failures raised by the middlewares themselves.
+const (
+	ErrTypeRateLimit  gin.ErrorType = 1 << 11
+	ErrTypeAuth       gin.ErrorType = 1 << 12
+	ErrTypePermission gin.ErrorType = 1 << 13
+	ErrTypeQuota      gin.ErrorType = 1 << 14
+	// ErrTypeOverload marks requests we turned away for lack of capacity,
+	// which are not failures of the provider.
+	ErrTypeOverload gin.ErrorType = 1 << 15
+)
+
+// OpenAI error "type" strings, as parsed by the official SDKs.
+const (
+	APIErrorInvalidRequest = "invalid_request_error"
+	APIErrorAuthentication = "authentication_error"
+	APIErrorPermission     = "permission_error"
+	APIErrorRateLimit      = "rate_limit_error"
+	APIErrorQuota          = "insufficient_quota"
+	APIErrorTimeout        = "timeout"
+	APIErrorServer         = "server_error"
+)
+
+var apiErrorTypes = map[gin.ErrorType]string{
+	ErrTypeClient:     APIErrorInvalidRequest,
+	ErrTypeAuth:       APIErrorAuthentication,
+	ErrTypePermission: APIErrorPermission,
+	ErrTypeRateLimit:  APIErrorRateLimit,
+	ErrTypeQuota:      APIErrorQuota,
+	ErrTypeTimeout:    APIErrorTimeout,
+	ErrTypeUpstream:   APIErrorServer,
+	ErrTypeOverload:   APIErrorServer,
+}
+
+// APIError is the body of an OpenAI-style error response:
+//
+//	{"error": {"message": "...", "type": "...", "code": "..."}}
+//
+// Details is our extension for structured failure data; SDKs ignore it.
+type APIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+	Details any     `json:"details,omitempty"`
+}
+
+type apiErrorEnvelope struct {
+	Error APIError `json:"error"`
+}
+
+// AbortWithAIError records err in c.Errors as kind and aborts with status
+// and an OpenAI-style error body, so customers' OpenAI SDKs can parse it.
+// code may be empty.
+func AbortWithAIError(c *gin.Context, status int, kind gin.ErrorType, code string, err error) {
+	apiErr := APIError{Message: err.Error(), Type: apiErrorTypes[kind]}
+	if apiErr.Type == "" {
+		apiErr.Type = APIErrorServer
+	}
+	if code != "" {
+		apiErr.Code = &code
+	}
+	abortWithAPIError(c, status, kind, err, apiErr)
+}
+
+func abortWithAPIError(c *gin.Context, status int, kind gin.ErrorType, err error, apiErr APIError) {
+	_ = c.Error(err).SetType(kind)
+	c.AbortWithStatusJSON(status, apiErrorEnvelope{Error: apiErr})
+}
+
+// Errors returned to clients by the AI middlewares.
+var (
+	errRateLimited           = errors.New("rate limit exceeded")
+	errRequestTimeout        = errors.New("request timed out")
+	errIdempotencyInProgress = errors.New("a request with this idempotency key is in progress")
+)
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// weightTolerance absorbs float rounding in weights such as 0.1+0.2+0.7.
+const weightTolerance = 1e-9
+
+// Variant is one arm of an experiment. An empty Model keeps the model chosen
+// by routing, which makes it the control.
+type Variant struct {
+	Name   string  `json:"name"`
+	Model  string  `json:"model,omitempty"`
+	Weight float64 `json:"weight"`
+}
+
+// Experiment splits traffic between variants by weight.
+type Experiment struct {
+	Name     string
+	Variants []Variant
+	// Routes, if set, limits the experiment to requests whose ai_route is
+	// listed.
+	Routes []string
+
+	// cumulative[i] is the upper bound of Variants[i] on [0, 1).
+	cumulative []float64
+}
+
+// NewExperiment validates variants: names must be unique and weights must be
+// non-negative and sum to 1.0.
+func NewExperiment(name string, variants []Variant, routes ...string) (*Experiment, error) {
+	if name == "" {
+		return nil, errors.New("experiment: name is required")
+	}
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("experiment %q: no variants", name)
+	}
+
+	var sum float64
+	cumulative := make([]float64, len(variants))
+	seen := make(map[string]bool, len(variants))
+	for i, v := range variants {
+		if v.Name == "" || seen[v.Name] {
+			return nil, fmt.Errorf("experiment %q: variant %d needs a unique name", name, i)
+		}
+		if v.Weight < 0 || math.IsNaN(v.Weight) {
+			return nil, fmt.Errorf("experiment %q: variant %q has invalid weight %v", name, v.Name, v.Weight)
+		}
+		seen[v.Name] = true
+		sum += v.Weight
+		cumulative[i] = sum
+	}
+	if math.Abs(sum-1) > weightTolerance {
+		return nil, fmt.Errorf("experiment %q: weights sum to %v, not 1.0", name, sum)
+	}
+
+	return &Experiment{
+		Name:       name,
+		Variants:   slices.Clone(variants),
+		Routes:     routes,
+		cumulative: cumulative,
+	}, nil
+}
+
+// assign picks the variant for unit, the same one every time for the same
+// unit. An empty unit is assigned at random.
+func (e *Experiment) assign(unit string) Variant {
+	var p float64
+	if unit == "" {
+		p = rand.Float64()
+	} else {
+		h := fnv.New64a()
+		h.Write([]byte(e.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(unit))
+		// 53 bits fill a float64 mantissa, giving a uniform value in [0, 1).
+		p = float64(h.Sum64()>>11) / (1 << 53)
+	}
+	for i, upper := range e.cumulative {
+		if p < upper {
+			return e.Variants[i]
+		}
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+// AIExperimentMiddleware assigns each request to a variant of the first
+// experiment that applies to its route, routes it to the variant's model and
+// tags it ai_experiment and ai_variant, so every metric can be sliced by
+// variant. Assignment hashes the Idempotency-Key, a client-supplied request
+// ID or the tenant, in that order, so retries land on the same variant.
+// Register it after AIRoutingMiddleware and AIAuthMiddleware.
+func AIExperimentMiddleware(experiments ...*Experiment) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.GetString(ContextKeyRoute)
+		for _, e := range experiments {
+			if len(e.Routes) > 0 && !slices.Contains(e.Routes, route) {
+				continue
+			}
+
+			variant := e.assign(experimentUnit(c))
+			if variant.Model != "" && !keyAllowsModel(c, variant.Model) {
+				// Keep the request out of the experiment rather than
+				// route it to a model its key may not use.
+				break
+			}
+			if variant.Model != "" {
+				c.Set(ContextKeyModel, variant.Model)
+			}
+			SetAITag(c, "ai_experiment", e.Name)
+			SetAITag(c, "ai_variant", variant.Name)
+			break
+		}
+		c.Next()
+	}
+}
+
+// experimentUnit returns what a request is assigned by. Generated request
+// IDs differ between retries, so only one sent by the client counts.
+func experimentUnit(c *gin.Context) string {
+	if key := c.GetHeader(HeaderIdempotencyKey); key != "" {
+		return key
+	}
+	if id := c.GetHeader(HeaderRequestID); validRequestID(id) {
+		return id
+	}
+	return c.GetString(ContextKeyTenant)
+}
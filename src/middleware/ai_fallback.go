@@ -0,0 +1,252 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FallbackRetryable reports whether a failed attempt should be retried on
+// the next model in the chain. outcome is the attempt's ai_outcome.
+type FallbackRetryable func(c *gin.Context, outcome string) bool
+
+// FallbackOptions configures AIFallbackMiddleware.
+type FallbackOptions struct {
+	// Retryable decides which failures fall back. Defaults to
+	// DefaultFallbackRetryable.
+	Retryable FallbackRetryable
+	// Breaker, if set, skips models whose breaker is open and records the
+	// result of every attempt. Do not also install Breaker.Middleware on
+	// the route, or attempts are counted twice.
+	Breaker *AICircuitBreaker
+}
+
+// DefaultFallbackRetryable falls back on upstream errors and upstream
+// timeouts. Client errors, validation errors and client deadlines do not
+// fall back: the next model would fail the same way.
+func DefaultFallbackRetryable(_ *gin.Context, outcome string) bool {
+	return outcome == OutcomeUpstreamError || outcome == OutcomeTimeout
+}
+
+// AIFallbackMiddleware runs handler against the request's model and, while
+// an attempt fails in a retryable way before writing a successful response,
+// again against the next model of chain. The model to call is stored under
+// ContextKeyModel before each attempt, so ai_model reports the one that
+// served the request; ai_fallback=true and ai_fallback_from are tagged when
+// it was not the first. The first model is the one resolved by
+// DefaultModelResolver, or chain[0] when there is none. Models of chain the
+// request's API key may not use are skipped; a key that may use none of them
+// gets 403. With no model at all, handler runs once as is.
+//
+// gin cannot replay the handlers after a middleware, so handler is the
+// route's terminal handler rather than the rest of the chain.
+func AIFallbackMiddleware(chain []string, handler gin.HandlerFunc, opts FallbackOptions) gin.HandlerFunc {
+	if opts.Retryable == nil {
+		opts.Retryable = DefaultFallbackRetryable
+	}
+
+	return func(c *gin.Context) {
+		models := fallbackModels(DefaultModelResolver(c), allowedModels(c, chain))
+		if len(models) == 0 && len(chain) > 0 {
+			// The key may use none of the chain.
+			abortModelNotAllowed(c, chain[0])
+			return
+		}
+		if len(models) == 0 || len(models) < 2 && opts.Breaker == nil {
+			handler(c)
+			return
+		}
+
+		body, err := requestBody(c)
+		if abortBodyTooLarge(c, err) {
+			return
+		}
+		if err != nil {
+			AbortWithAIError(c, http.StatusBadRequest, ErrTypeClient, "invalid_body", err)
+			return
+		}
+
+		orig := c.Writer
+		baseHeader := orig.Header().Clone()
+		baseErrors := len(c.Errors)
+		defer func() { c.Writer = orig }()
+
+		served := ""
+		for i, model := range models {
+			last := i == len(models)-1
+			if served != "" {
+				// Undo the failed attempt before handing the request on.
+				resetHeader(orig.Header(), baseHeader)
+				c.Errors = c.Errors[:baseErrors]
+				c.Set(ContextKeyOutcome, "")
+				c.Request.Body = io.NopCloser(bytes.NewReader(body))
+				c.Writer = orig
+			}
+			if opts.Breaker != nil && !opts.Breaker.Allow(model) {
+				if !last {
+					continue
+				}
+				SetAITag(c, "ai_breaker_state", opts.Breaker.State(model).String())
+				AbortWithAIError(c, http.StatusServiceUnavailable, ErrTypeUpstream, "model_unavailable", ErrCircuitOpen)
+				break
+			}
+			served = model
+			c.Set(ContextKeyModel, model)
+
+			w := &fallbackWriter{ResponseWriter: orig, status: http.StatusOK}
+			c.Writer = w
+			handler(c)
+
+			outcome := classifyOutcome(c, w.Status())
+			if opts.Breaker != nil {
+				if outcome != OutcomeClientDisconnected && outcome != OutcomeOverloaded {
+					opts.Breaker.Record(model, outcome != OutcomeUpstreamError && outcome != OutcomeTimeout)
+				}
+				SetAITag(c, "ai_breaker_state", opts.Breaker.State(model).String())
+			}
+			if w.passthrough || outcome == OutcomeOK || last ||
+				c.Request.Context().Err() != nil || !opts.Retryable(c, outcome) {
+				w.release()
+				break
+			}
+		}
+
+		if served != "" && served != models[0] {
+			SetAITag(c, "ai_fallback", "true")
+			SetAITag(c, "ai_fallback_from", models[0])
+		}
+	}
+}
+
+// fallbackModels returns primary followed by the rest of chain, without
+// duplicates. A primary listed in chain falls back to the models after it.
+func fallbackModels(primary string, chain []string) []string {
+	start := 0
+	if primary != "" {
+		start = len(chain)
+		for i, model := range chain {
+			if model == primary {
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	models := make([]string, 0, len(chain)+1)
+	if primary != "" {
+		models = append(models, primary)
+	}
+	for _, model := range chain[start:] {
+		if model != primary {
+			models = append(models, model)
+		}
+	}
+	return models
+}
+
+// allowedModels drops the models of chain the request's API key may not use.
+func allowedModels(c *gin.Context, chain []string) []string {
+	return slices.DeleteFunc(slices.Clone(chain), func(model string) bool {
+		return !keyAllowsModel(c, model)
+	})
+}
+
+func resetHeader(h, base http.Header) {
+	for key := range h {
+		delete(h, key)
+	}
+	for key, values := range base {
+		h[key] = values
+	}
+}
+
+// fallbackWriter holds back an attempt's error response so it can be
+// dropped if the next model is tried. A successful response goes straight
+// to the client, which rules out falling back once it has started.
+type fallbackWriter struct {
+	gin.ResponseWriter
+
+	status      int
+	held        bytes.Buffer
+	holding     bool
+	passthrough bool
+}
+
+func (w *fallbackWriter) WriteHeader(code int) {
+	if code > 0 && !w.Written() {
+		w.status = code
+	}
+}
+
+func (w *fallbackWriter) WriteHeaderNow() {
+	if w.commit() {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *fallbackWriter) Write(b []byte) (int, error) {
+	if w.commit() {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.held.Write(b)
+}
+
+func (w *fallbackWriter) WriteString(s string) (int, error) {
+	if w.commit() {
+		return w.ResponseWriter.WriteString(s)
+	}
+	return w.held.WriteString(s)
+}
+
+func (w *fallbackWriter) Flush() {
+	if w.commit() {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// commit decides, on the first write, whether the response is passed
+// through or held, and reports whether it is passed through.
+func (w *fallbackWriter) commit() bool {
+	if !w.Written() {
+		if w.status >= http.StatusBadRequest {
+			w.holding = true
+		} else {
+			w.passthrough = true
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+	}
+	return w.passthrough
+}
+
+func (w *fallbackWriter) Status() int {
+	return w.status
+}
+
+func (w *fallbackWriter) Written() bool {
+	return w.holding || w.passthrough
+}
+
+func (w *fallbackWriter) Size() int {
+	switch {
+	case w.passthrough:
+		return w.ResponseWriter.Size()
+	case w.holding:
+		return w.held.Len()
+	}
+	return -1
+}
+
+// release sends a held response, or the pending status of an unwritten
+// one, to the client.
+func (w *fallbackWriter) release() {
+	if w.passthrough {
+		return
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.holding {
+		_, _ = w.ResponseWriter.Write(w.held.Bytes())
+	}
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFallbackWithoutModels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys := NewMemoryKeyStore()
+	keys.Add("sk-scoped", &APIKeyRecord{Tenant: "acme", Models: []string{"claude-3-haiku"}})
+	breaker := NewAICircuitBreaker(CircuitBreakerOptions{})
+
+	tests := []struct {
+		name        string
+		chain       []string
+		auth        bool
+		wantCode    int
+		wantHandled bool
+	}{
+		{name: "empty chain", wantCode: http.StatusOK, wantHandled: true},
+		{name: "chain outside the key scope", chain: []string{"gpt-4o", "gpt-4o-mini"}, auth: true, wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled := false
+			handler := func(c *gin.Context) {
+				handled = true
+				c.String(http.StatusOK, "ok")
+			}
+			chain := []gin.HandlerFunc{AIFallbackMiddleware(tt.chain, handler, FallbackOptions{Breaker: breaker})}
+			if tt.auth {
+				chain = append([]gin.HandlerFunc{AIAuthMiddleware(keys)}, chain...)
+			}
+			r := gin.New()
+			r.POST("/ai/chat", chain...)
+
+			req := httptest.NewRequest(http.MethodPost, "/ai/chat", nil)
+			req.Header.Set("Authorization", "Bearer sk-scoped")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if handled != tt.wantHandled {
+				t.Errorf("handler ran = %v, want %v", handled, tt.wantHandled)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != "ok" {
+				t.Errorf("body %q, want the handler's response", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProviderCheck reports whether a model provider is reachable.
+type ProviderCheck func(ctx context.Context) error
+
+// HTTPProviderCheck pings url with a GET. Any response below 500 counts as
+// reachable, so unauthenticated 401s from a provider are fine. A nil client
+// uses http.DefaultClient.
+func HTTPProviderCheck(client *http.Client, url string) ProviderCheck {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("provider returned %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// ReadinessOptions configures ReadinessHandler.
+type ReadinessOptions struct {
+	// Breaker, if set, marks every provider with an open breaker as down.
+	Breaker *AICircuitBreaker
+	// Providers are pinged by name on each (uncached) check.
+	Providers map[string]ProviderCheck
+	// CacheTTL is how long a result is reused. Defaults to 5s.
+	CacheTTL time.Duration
+	// CheckTimeout bounds each provider ping. Defaults to 2s.
+	CheckTimeout time.Duration
+}
+
+// readinessReport is the body served by ReadinessHandler.
+type readinessReport struct {
+	Status    string            `json:"status"`
+	Timestamp time.Time         `json:"timestamp"`
+	Providers map[string]string `json:"providers"`
+	Down      []string          `json:"down,omitempty"`
+}
+
+// LivenessHandler answers 200 while the process is able to serve requests.
+func LivenessHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
+
+// ReadinessHandler answers 200 when every provider is up and 503 with the
+// list of down providers otherwise. Results are cached for opts.CacheTTL so
+// probes do not hammer the providers.
+func ReadinessHandler(opts ReadinessOptions) gin.HandlerFunc {
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = 5 * time.Second
+	}
+	if opts.CheckTimeout <= 0 {
+		opts.CheckTimeout = 2 * time.Second
+	}
+
+	var (
+		mu     sync.Mutex
+		cached *readinessReport
+	)
+	return func(c *gin.Context) {
+		mu.Lock()
+		if cached == nil || time.Since(cached.Timestamp) >= opts.CacheTTL {
+			cached = checkReadiness(c.Request.Context(), opts)
+		}
+		report := cached
+		mu.Unlock()
+
+		status := http.StatusOK
+		if len(report.Down) > 0 {
+			status = http.StatusServiceUnavailable
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.JSON(status, report)
+	}
+}
+
+func checkReadiness(ctx context.Context, opts ReadinessOptions) *readinessReport {
+	report := &readinessReport{
+		Status:    "ready",
+		Timestamp: time.Now(),
+		Providers: make(map[string]string),
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for name, check := range opts.Providers {
+		wg.Add(1)
+		go func(name string, check ProviderCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), opts.CheckTimeout)
+			defer cancel()
+
+			state := "up"
+			if err := check(ctx); err != nil {
+				state = "down"
+			}
+			mu.Lock()
+			report.Providers[name] = state
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	if opts.Breaker != nil {
+		for key, state := range opts.Breaker.States() {
+			if state == BreakerOpen {
+				report.Providers[key] = "down"
+			} else if _, ok := report.Providers[key]; !ok {
+				report.Providers[key] = "up"
+			}
+		}
+	}
+
+	for name, state := range report.Providers {
+		if state == "down" {
+			report.Down = append(report.Down, name)
+		}
+	}
+	if len(report.Down) > 0 {
+		sort.Strings(report.Down)
+		report.Status = "not_ready"
+	}
+	return report
+}
@@ -0,0 +1,304 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Idempotency headers.
+const (
+	HeaderIdempotencyKey   = "Idempotency-Key"
+	HeaderIdempotentReplay = "X-Idempotent-Replay"
+)
+
+const (
+	defaultIdempotencyTTL  = 24 * time.Hour
+	defaultIdempotencyLock = 5 * time.Minute
+	defaultIdempotencyWait = 30 * time.Second
+	defaultIdempotencyPoll = 100 * time.Millisecond
+)
+
+// ErrIdempotencyInProgress is returned by IdempotencyStore.Acquire while
+// another request holds the key.
+var ErrIdempotencyInProgress = errors.New("idempotency: request in progress")
+
+// CachedResponse is a complete response stored for replay.
+type CachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	// StoredAt is when the response was stored; zero if unknown.
+	StoredAt time.Time
+}
+
+// IdempotencyStore records responses by idempotency key.
+type IdempotencyStore interface {
+	// Acquire claims key for a new request for ttl and returns nil, nil. If
+	// key has completed it returns the stored response; if another request
+	// holds the claim it returns ErrIdempotencyInProgress.
+	Acquire(ctx context.Context, key string, ttl time.Duration) (*CachedResponse, error)
+	// Complete stores resp for key for ttl and releases the claim.
+	Complete(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration) error
+	// Release drops the claim on key without storing a response.
+	Release(ctx context.Context, key string) error
+}
+
+// IdempotencyOptions configures AIIdempotencyMiddleware.
+type IdempotencyOptions struct {
+	// TTL is how long responses are kept. Defaults to 24h.
+	TTL time.Duration
+	// LockTTL is how long the claim of an unfinished request holds the key,
+	// so a process that crashes, or fails to release it, does not block the
+	// key for TTL. Set it to the request timeout plus a margin. Defaults to
+	// 5m.
+	LockTTL time.Duration
+	// WaitForInFlight makes a duplicate of an unfinished request wait for it
+	// instead of failing with 409.
+	WaitForInFlight bool
+	// WaitTimeout bounds the wait. Defaults to 30s.
+	WaitTimeout time.Duration
+	// PollInterval is how often a waiting request checks the store.
+	// Defaults to 100ms.
+	PollInterval time.Duration
+}
+
+// AIIdempotencyMiddleware replays the stored response for requests that repeat
+// an Idempotency-Key, so a retried POST does not generate (and bill) a second
+// completion. Only 2xx responses are stored; errors release the key so the
+// request can be retried. Keys are scoped to the caller's API key. Requests
+// without the header pass through.
+func AIIdempotencyMiddleware(store IdempotencyStore, opts IdempotencyOptions) gin.HandlerFunc {
+	if opts.TTL <= 0 {
+		opts.TTL = defaultIdempotencyTTL
+	}
+	if opts.LockTTL <= 0 {
+		opts.LockTTL = defaultIdempotencyLock
+	}
+	if opts.WaitTimeout <= 0 {
+		opts.WaitTimeout = defaultIdempotencyWait
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultIdempotencyPoll
+	}
+
+	return func(c *gin.Context) {
+		idempotencyKey := c.GetHeader(HeaderIdempotencyKey)
+		if idempotencyKey == "" {
+			c.Next()
+			return
+		}
+		key := apiKeyScoped(apiKeyFromRequest(c.Request), idempotencyKey)
+
+		cached, err := acquireIdempotencyKey(c.Request.Context(), store, key, opts)
+		switch {
+		case errors.Is(err, ErrIdempotencyInProgress):
+			AbortWithAIError(c, http.StatusConflict, ErrTypeClient, "idempotency_key_in_use", errIdempotencyInProgress)
+			return
+		case err != nil:
+			// Fail open: without the store we can only process the request.
+			_ = c.Error(err)
+			c.Next()
+			return
+		case cached != nil:
+			c.Header(HeaderIdempotentReplay, "true")
+			writeCachedResponse(c, cached)
+			return
+		}
+
+		ctx := context.WithoutCancel(c.Request.Context())
+		stored := false
+		defer func() {
+			// Deferred so a panicking handler does not leave the key claimed.
+			if stored {
+				return
+			}
+			if err := store.Release(ctx, key); err != nil {
+				_ = c.Error(err)
+			}
+		}()
+
+		recorder := newBodyRecorder(c.Writer)
+		c.Writer = recorder
+		c.Next()
+
+		// Only successes are stored; errors such as 429 or 5xx are released
+		// so the client can retry them.
+		if status := recorder.Status(); status >= http.StatusOK && status < http.StatusMultipleChoices {
+			if err := store.Complete(ctx, key, recorder.response(), opts.TTL); err != nil {
+				_ = c.Error(err)
+				return
+			}
+			stored = true
+		}
+	}
+}
+
+// acquireIdempotencyKey claims key, polling while another request holds it
+// if opts.WaitForInFlight is set.
+func acquireIdempotencyKey(ctx context.Context, store IdempotencyStore, key string, opts IdempotencyOptions) (*CachedResponse, error) {
+	cached, err := store.Acquire(ctx, key, opts.LockTTL)
+	if !errors.Is(err, ErrIdempotencyInProgress) || !opts.WaitForInFlight {
+		return cached, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.WaitTimeout)
+	defer cancel()
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ErrIdempotencyInProgress
+		case <-ticker.C:
+		}
+		cached, err = store.Acquire(ctx, key, opts.LockTTL)
+		if !errors.Is(err, ErrIdempotencyInProgress) {
+			return cached, err
+		}
+	}
+}
+
+// unreplayedHeaders belong to the connection or to the request that stored
+// the response, not to the response itself, so they are not replayed.
+var unreplayedHeaders = headerSet(append([]string{
+	HeaderRequestID,
+	"Connection", "Keep-Alive", "Proxy-Connection", "TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}, encodingHeaders...)...)
+
+// headerSet returns the canonical forms of keys, for lookups by
+// http.CanonicalHeaderKey.
+func headerSet(keys ...string) map[string]bool {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[http.CanonicalHeaderKey(key)] = true
+	}
+	return set
+}
+
+// writeCachedResponse writes resp to the client and aborts the chain.
+func writeCachedResponse(c *gin.Context, resp *CachedResponse) {
+	for key, values := range resp.Header {
+		if unreplayedHeaders[http.CanonicalHeaderKey(key)] {
+			continue
+		}
+		c.Writer.Header()[key] = values
+	}
+	c.Writer.WriteHeader(resp.Status)
+	_, _ = c.Writer.Write(resp.Body)
+	c.Abort()
+}
+
+// bodyRecorder tees the response so it can be stored after the handler ran.
+type bodyRecorder struct {
+	gin.ResponseWriter
+
+	body bytes.Buffer
+}
+
+func newBodyRecorder(w gin.ResponseWriter) *bodyRecorder {
+	return &bodyRecorder{ResponseWriter: w}
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// encodingHeaders describe the encoding of the body on the wire. Outer
+// wrappers such as AICompressionMiddleware set them on the header map shared
+// by every writer, while the recorder sees the unencoded body.
+var encodingHeaders = []string{"Content-Encoding", "Content-Length", "Vary"}
+
+func (w *bodyRecorder) response() *CachedResponse {
+	header := w.Header().Clone()
+	for _, key := range encodingHeaders {
+		header.Del(key)
+	}
+	return &CachedResponse{
+		Status: w.Status(),
+		Header: header,
+		Body:   bytes.Clone(w.body.Bytes()),
+	}
+}
+
+// memorySweepInterval is how often the in-process stores drop expired
+// entries.
+const memorySweepInterval = time.Minute
+
+// MemoryIdempotencyStore is an in-process IdempotencyStore for tests and
+// single instance deployments. Expired entries are swept once a minute.
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	resp    *CachedResponse
+	expires time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		entries: make(map[string]*idempotencyEntry),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryIdempotencyStore) Acquire(_ context.Context, key string, ttl time.Duration) (*CachedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		if e.resp == nil {
+			return nil, ErrIdempotencyInProgress
+		}
+		return e.resp, nil
+	}
+	s.entries[key] = &idempotencyEntry{expires: now.Add(ttl)}
+	return nil, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(_ context.Context, key string, resp *CachedResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = &idempotencyEntry{resp: resp, expires: s.now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// sweep drops expired entries, at most once per memorySweepInterval. The
+// caller holds s.mu.
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < memorySweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
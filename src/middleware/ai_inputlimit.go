@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tokenizer counts the tokens of a prompt for model. A BPE tokenizer
+// matching the provider gives exact counts; HeuristicTokenizer estimates.
+type Tokenizer interface {
+	CountTokens(model, text string) int
+}
+
+// HeuristicTokenizer estimates one token per four characters, which is
+// close for English and errs high for most other scripts.
+type HeuristicTokenizer struct{}
+
+func (HeuristicTokenizer) CountTokens(_, text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// InputLimitOptions configures AIInputLimitMiddleware.
+type InputLimitOptions struct {
+	// Tokenizer defaults to HeuristicTokenizer.
+	Tokenizer Tokenizer
+	// Limits maps models to their maximum input tokens. Models not listed
+	// use DefaultLimit; zero means no limit.
+	Limits       map[string]int
+	DefaultLimit int
+	// MaxBodyBytes rejects larger bodies with 413. Zero means
+	// DefaultMaxBodyBytes. A body read earlier in the chain, as
+	// AIAuthMiddleware does to check the model, has already been buffered up
+	// to DefaultMaxBodyBytes; register AIBodyLimitMiddleware first to cap it
+	// before that.
+	MaxBodyBytes int64
+	// ModelResolver defaults to DefaultModelResolver, then the model field
+	// of the body.
+	ModelResolver ModelResolver
+}
+
+// AIInputLimitMiddleware estimates the input tokens of each completion
+// request and rejects those over the model's limit with 413, stating the
+// limit and the estimate. Rejected requests get ai_outcome=input_too_large.
+func AIInputLimitMiddleware(opts InputLimitOptions) gin.HandlerFunc {
+	if opts.Tokenizer == nil {
+		opts.Tokenizer = HeuristicTokenizer{}
+	}
+	if opts.ModelResolver == nil {
+		opts.ModelResolver = DefaultModelResolver
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+
+	return func(c *gin.Context) {
+		body, err := readBody(c, opts.MaxBodyBytes)
+		if abortBodyTooLarge(c, err) {
+			return
+		}
+		var req *completionRequest
+		if err == nil {
+			req, err = decodeCompletionRequest(body)
+		}
+		if err != nil {
+			// Unparseable bodies are left for validation to reject.
+			c.Next()
+			return
+		}
+
+		model := opts.ModelResolver(c)
+		if model == "" {
+			model = req.Model
+		}
+		estimated, overLimit := opts.checkTokens(model, req.promptText())
+		if estimated > 0 {
+			SetAIExtra(c, "ai_input_tokens_estimated", estimated)
+		}
+		if overLimit != nil {
+			abortInputTooLarge(c, overLimit, overLimit.details())
+			return
+		}
+		c.Next()
+	}
+}
+
+// AIBodyLimitMiddleware reads the request body up to maxBytes and rejects
+// larger bodies with 413 and ai_outcome=input_too_large. Register it before
+// any middleware that reads the body, such as AIAuthMiddleware, so no body is
+// buffered past maxBytes.
+func AIBodyLimitMiddleware(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := readBody(c, maxBytes); abortBodyTooLarge(c, err) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// abortBodyTooLarge aborts with 413 if err is from a body over its limit.
+func abortBodyTooLarge(c *gin.Context, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	abortInputTooLarge(c, fmt.Errorf("request body exceeds the limit of %d bytes", tooLarge.Limit),
+		gin.H{"limit_bytes": tooLarge.Limit})
+	return true
+}
+
+// inputTooLargeError is a prompt over its model's token limit.
+type inputTooLargeError struct {
+	model            string
+	limit, estimated int
+}
+
+func (e *inputTooLargeError) Error() string {
+	return fmt.Sprintf("the prompt is about %d tokens, more than the %d token limit of model %q", e.estimated, e.limit, e.model)
+}
+
+func (e *inputTooLargeError) details() gin.H {
+	return gin.H{"limit_tokens": e.limit, "estimated_tokens": e.estimated}
+}
+
+// checkTokens estimates the tokens of text and checks them against the limit
+// of model. The estimate is zero when the model has no limit.
+func (opts *InputLimitOptions) checkTokens(model, text string) (int, *inputTooLargeError) {
+	limit, ok := opts.Limits[model]
+	if !ok {
+		limit = opts.DefaultLimit
+	}
+	if limit <= 0 {
+		return 0, nil
+	}
+	tokenizer := opts.Tokenizer
+	if tokenizer == nil {
+		tokenizer = HeuristicTokenizer{}
+	}
+	estimated := tokenizer.CountTokens(model, text)
+	if estimated <= limit {
+		return estimated, nil
+	}
+	return estimated, &inputTooLargeError{model: model, limit: limit, estimated: estimated}
+}
+
+func abortInputTooLarge(c *gin.Context, err error, details gin.H) {
+	SetAIOutcome(c, OutcomeInputTooLarge)
+	abortWithAPIError(c, http.StatusRequestEntityTooLarge, ErrTypeClient, err, inputTooLargeAPIError(err, details))
+}
+
+func inputTooLargeAPIError(err error, details gin.H) APIError {
+	code := "input_too_large"
+	return APIError{
+		Message: err.Error(),
+		Type:    APIErrorInvalidRequest,
+		Code:    &code,
+		Details: details,
+	}
+}
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// countingBody is an endless request body that counts the bytes read
+// from it.
+type countingBody struct {
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	b.read += int64(len(p))
+	return len(p), nil
+}
+
+func (b *countingBody) Close() error { return nil }
+
+func TestInputLimitBodyCapBehindAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys := NewMemoryKeyStore()
+	keys.Add("sk-test", &APIKeyRecord{Tenant: "acme", Models: []string{"gpt-4o"}})
+
+	tests := []struct {
+		name     string
+		chain    []gin.HandlerFunc
+		body     func() io.ReadCloser
+		maxRead  int64
+		wantCode int
+	}{
+		{
+			name:  "input limit after auth",
+			chain: []gin.HandlerFunc{AIAuthMiddleware(keys), AIInputLimitMiddleware(InputLimitOptions{MaxBodyBytes: 1 << 10})},
+			body: func() io.ReadCloser {
+				return io.NopCloser(strings.NewReader(`{"model":"gpt-4o","prompt":"` + strings.Repeat("a", 4<<10) + `"}`))
+			},
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "default cap with auth first",
+			chain:    []gin.HandlerFunc{AIAuthMiddleware(keys), AIInputLimitMiddleware(InputLimitOptions{})},
+			maxRead:  DefaultMaxBodyBytes + 1,
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "body limit before auth",
+			chain:    []gin.HandlerFunc{AIBodyLimitMiddleware(1 << 10), AIAuthMiddleware(keys), AIInputLimitMiddleware(InputLimitOptions{})},
+			maxRead:  1<<10 + 1,
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled := false
+			r := gin.New()
+			r.POST("/ai/chat", append(tt.chain, func(c *gin.Context) {
+				handled = true
+				c.Status(http.StatusOK)
+			})...)
+
+			counter := &countingBody{}
+			req := httptest.NewRequest(http.MethodPost, "/ai/chat", nil)
+			req.Body = counter
+			if tt.body != nil {
+				req.Body = tt.body()
+			}
+			req.Header.Set("Authorization", "Bearer sk-test")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if handled {
+				t.Error("handler ran for a body over the limit")
+			}
+			if tt.maxRead > 0 && counter.read > tt.maxRead {
+				t.Errorf("read %d bytes of the body, want at most %d", counter.read, tt.maxRead)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// AILoggingMiddleware writes one structured log line per request, carrying
+// the Sentry trace ID so logs and traces can be joined. Model and token
+// fields are read from the same context keys as AIMetricsMiddleware; register
+// it before the metrics middleware to log the values it resolved. 5xx
+// responses log at error level and 4xx at warn.
+func AILoggingMiddleware(logger *slog.Logger) gin.HandlerFunc {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		status := c.Writer.Status()
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", routeLabel(c)),
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("model", loggedModel(c)),
+		}
+		if usage, ok := resolveTokens(c, HeaderTokenExtractor); ok {
+			attrs = append(attrs,
+				slog.Int("tokens_prompt", usage.Prompt),
+				slog.Int("tokens_completion", usage.Completion),
+			)
+		}
+		if requestID := RequestIDFromContext(c); requestID != "" {
+			attrs = append(attrs, slog.String("request_id", requestID))
+		}
+		if traceID := traceIDFromRequest(c.Request); traceID != "" {
+			attrs = append(attrs, slog.String("trace_id", traceID))
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+		logger.LogAttrs(c.Request.Context(), level, "ai request", attrs...)
+	}
+}
+
+func loggedModel(c *gin.Context) string {
+	if model := DefaultModelResolver(c); model != "" {
+		return model
+	}
+	return unknownModel
+}
+
+// traceIDFromRequest returns the trace ID of the request span, or of the
+// incoming sentry-trace header when the request was not traced.
+func traceIDFromRequest(r *http.Request) string {
+	if span := sentry.SpanFromContext(r.Context()); span != nil {
+		return span.TraceID.String()
+	}
+	return traceIDFromHeader(r.Header.Get(sentry.SentryTraceHeader))
+}
@@ -1,29 +1,244 @@
+package middleware
+
 // أضف تكامل Sentry
 import (
-    "github.com/getsentry/sentry-go"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Response headers read by the default token extractor.
+const (
+	HeaderTokensPrompt     = "X-AI-Tokens-Prompt"
+	HeaderTokensCompletion = "X-AI-Tokens-Completion"
 )
 
-func AIMetricsMiddleware() gin.HandlerFunc {
-    return func(c *gin.Context) {
-        start := time.Now()
-        
-        // Start Sentry transaction
-        span := sentry.StartSpan(c.Request.Context(), "ai.request",
-            sentry.WithTransactionName(fmt.Sprintf("ai.%s", c.Request.URL.Path)),
-        )
-        defer span.Finish()
-        
-        c.Next()
-        
-        // Record metrics
-        duration := time.Since(start)
-        status := c.Writer.Status()
-        
-        // Send to Sentry
-        sentry.ConfigureScope(func(scope *sentry.Scope) {
-            scope.SetExtra("ai_request_duration", duration.Milliseconds())
-            scope.SetExtra("ai_response_status", status)
-            scope.SetTag("ai_endpoint", c.Request.URL.Path)
-        })
-    }
-}
\ No newline at end of file
+// HeaderModel is the request header read by the default model resolver.
+const HeaderModel = "X-AI-Model"
+
+// unknownModel is tagged when no model can be resolved, so every request
+// carries an ai_model tag.
+const unknownModel = "unknown"
+
+// TokenExtractor reports the prompt and completion token counts consumed by
+// a request. It runs after the handler, so the response is available. ok is
+// false when the counts are unknown.
+type TokenExtractor func(c *gin.Context) (prompt, completion int, ok bool)
+
+// ModelResolver returns the model that served a request, or "" if unknown.
+type ModelResolver func(c *gin.Context) string
+
+// HeaderTokenExtractor reads token counts from the X-AI-Tokens-* response
+// headers set by the handler.
+func HeaderTokenExtractor(c *gin.Context) (prompt, completion int, ok bool) {
+	h := c.Writer.Header()
+	prompt, err := strconv.Atoi(h.Get(HeaderTokensPrompt))
+	if err != nil {
+		return 0, 0, false
+	}
+	completion, err = strconv.Atoi(h.Get(HeaderTokensCompletion))
+	if err != nil {
+		return 0, 0, false
+	}
+	return prompt, completion, true
+}
+
+// DefaultModelResolver prefers the model stored under ContextKeyModel by the
+// routing layer and falls back to the X-AI-Model request header.
+func DefaultModelResolver(c *gin.Context) string {
+	if model := c.GetString(ContextKeyModel); model != "" {
+		return model
+	}
+	return c.GetHeader(HeaderModel)
+}
+
+// AIMetricsMiddleware records a span and Sentry metrics (duration, status,
+// model, tokens, outcome) for each AI request. Called without options it
+// traces every request with Sentry, reads tokens from the X-AI-Tokens-*
+// headers and the model from DefaultModelResolver; see the With* options to
+// change that.
+func AIMetricsMiddleware(opts ...Option) gin.HandlerFunc {
+	cfg := newMetricsConfig(opts)
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		writer := newAIResponseWriter(c.Writer)
+		writer.usage = &sseUsageScanner{onUsage: func(usage TokenUsage) {
+			// Stream usage beats the extractor, for every reader of the key.
+			c.Set(ContextKeyTokens, usage)
+		}}
+		writer.errCount = func() int { return len(c.Errors) }
+		c.Writer = writer
+		probe := syntheticFromContext(c.Request.Context())
+		if probe != nil && !probe.replay {
+			c.Set(ContextKeyCanary, true)
+		}
+
+		var requestBody *cappedBuffer
+		if cfg.capture != nil {
+			writer.capture = newCappedBuffer(cfg.capture.maxBytes)
+			if c.Request.Body != nil {
+				requestBody = newCappedBuffer(cfg.capture.maxBytes)
+			}
+		} else if cfg.deadLetter != nil && c.Request.Body != nil {
+			requestBody = newCappedBuffer(deadLetterMaxBody)
+		}
+		if requestBody != nil {
+			c.Request.Body = &captureReadCloser{ReadCloser: c.Request.Body, buf: requestBody}
+		}
+
+		// Start the request span
+		parent := c.Request
+		name := transactionName(c)
+		sampled := sampleRequest(c.Request, cfg.sampleRate)
+		ctx, span := cfg.tracer.StartSpan(parent, name, SpanOptions{Start: start, Sampled: sampled})
+		ctx = withScrubber(ctx, func() *scrubber { return cfg.scrubFor(c.GetString(ContextKeyTenant)) })
+		ctx = withTracer(ctx, cfg.tracer)
+		c.Request = c.Request.WithContext(ctx)
+		defer func() {
+			if rec := recover(); rec != nil {
+				if !isAbortHandler(rec) {
+					// The panic skips the metrics below; it is answered 500.
+					if probe != nil {
+						probe.record(cfg.modelResolver(c), c.GetString(ContextKeyRoute), OutcomeInternalError)
+					}
+					if cfg.prom != nil && !c.GetBool(ContextKeyCanary) && (probe == nil || !probe.replay) {
+						cfg.prom.observe(routeLabel(c), http.StatusInternalServerError, time.Since(start))
+					}
+				}
+				if c.GetBool(contextKeyRecovery) {
+					// AIRecoveryMiddleware reports the panic in the open span.
+					c.Set(contextKeyOpenSpan, span)
+				} else {
+					span.Finish()
+				}
+				panic(rec)
+			}
+			span.Finish()
+		}()
+
+		c.Next()
+
+		// Record metrics
+		duration := time.Since(start)
+		ttfb := writer.timeToFirstByte(start, duration)
+		status := c.Writer.Status()
+		tokens, hasTokens := resolveTokens(c, cfg.tokenExtractor)
+		budget := cfg.budgetFor(c.FullPath())
+		slow := budget > 0 && duration > budget
+		model := cfg.modelResolver(c)
+		if model == "" {
+			model = unknownModel
+		} else {
+			// Share the resolved model with AILoggingMiddleware.
+			c.Set(ContextKeyModel, model)
+		}
+		// A stream that fails after the headers went out still reports 200.
+		disconnected := clientDisconnected(c)
+		streamFailed := writer.streamFailed() && !disconnected
+		if streamFailed {
+			SetAITag(c, "ai_stream_failed", "true")
+			if c.GetString(ContextKeyOutcome) == "" {
+				SetAIOutcome(c, OutcomePartialFailure)
+			}
+			if cfg.deadLetter != nil {
+				storeDeadLetter(c, cfg.deadLetter, newDeadLetter(c, requestBody, writer.Size(), model))
+			}
+		}
+		outcome := classifyOutcome(c, status)
+		if (outcome == OutcomeTimeout || outcome == OutcomeClientTimeout) && !c.Writer.Written() {
+			// AITimeoutMiddleware writes the 504 after this middleware returns.
+			status = http.StatusGatewayTimeout
+		}
+		if outcome == OutcomeClientDisconnected {
+			// Whatever the handler wrote after the cancellation, nobody read it.
+			status = statusClientClosedRequest
+		}
+
+		canary := c.GetBool(ContextKeyCanary)
+		replay := probe != nil && probe.replay
+		if probe != nil {
+			probe.record(model, c.GetString(ContextKeyRoute), outcome)
+		}
+		if cfg.prom != nil && !canary && !replay {
+			cfg.prom.observe(routeLabel(c), status, duration)
+		}
+
+		// Failures are always traced, even when sampled out up front.
+		if !sampled && status >= http.StatusInternalServerError {
+			span.Finish()
+			_, span = cfg.tracer.StartSpan(parent, name, SpanOptions{Start: start, Sampled: true})
+		}
+		tenant := c.GetString(ContextKeyTenant)
+		scrub := cfg.scrubFor(tenant)
+		span = &scrubbedSpan{Span: span, s: scrub}
+
+		span.SetExtra("ai_request_duration", duration.Milliseconds())
+		span.SetExtra("ai_ttfb_ms", ttfb.Milliseconds())
+		span.SetExtra("ai_total_ms", duration.Milliseconds())
+		span.SetExtra("ai_response_status", status)
+		span.SetTag("ai_endpoint", routeLabel(c))
+		span.SetTag("ai_model", model)
+		span.SetTag("ai_outcome", outcome)
+		if tenant != "" {
+			span.SetTag("ai_tenant", tenant)
+		}
+		if canary {
+			span.SetTag("ai_canary", "true")
+		}
+		if replay {
+			span.SetTag("ai_replay", "true")
+		}
+
+		// Zeros would skew the dashboards, so unknown counts are left out.
+		if hasTokens {
+			span.SetExtra("ai_tokens_prompt", tokens.Prompt)
+			span.SetExtra("ai_tokens_completion", tokens.Completion)
+			span.SetExtra("ai_tokens_total", tokens.Total())
+		}
+
+		if status >= http.StatusInternalServerError || streamFailed {
+			span.SetLevel(SpanLevelError)
+		} else if slow {
+			span.SetLevel(SpanLevelWarning)
+		}
+		if slow {
+			span.SetTag("ai_slow", "true")
+		}
+		for key, value := range aiTags(c) {
+			span.SetTag(key, value)
+		}
+		for key, value := range aiExtras(c) {
+			span.SetExtra(key, value)
+		}
+
+		if cfg.capture != nil && status >= http.StatusBadRequest {
+			span.SetExtra("ai_request_headers", scrub.requestHeaders(c.Request.Header))
+			if requestBody != nil {
+				span.SetExtra("ai_request_body", requestBody.render(cfg.capture.redactor, scrub))
+			}
+			if writer.streaming() {
+				span.SetTag("ai_response_capture", "skipped_stream")
+			} else {
+				span.SetExtra("ai_response_body", writer.capture.render(cfg.capture.redactor, scrub))
+			}
+		}
+	}
+}
+
+// transactionName groups requests by method and route template. The raw path
+// is only used when no route matched.
+func transactionName(c *gin.Context) string {
+	path := c.FullPath()
+	if path == "" {
+		path = c.Request.URL.Path
+	}
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return fmt.Sprintf("ai.%s %s", strings.ToLower(c.Request.Method), path)
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTransactionName(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "matched", path: "/ai/chat/42", want: "ai.post /ai/chat/:id"},
+		{name: "trailing slash", path: "/ai/models/", want: "ai.post /ai/models"},
+		{name: "unmatched", path: "/ai/nope/", want: "ai.post /ai/nope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			r := gin.New()
+			r.RedirectTrailingSlash = false
+			r.Use(func(c *gin.Context) {
+				c.Next()
+				got = transactionName(c)
+			})
+			r.POST("/ai/chat/:id", func(c *gin.Context) {})
+			r.POST("/ai/models/", func(c *gin.Context) {})
+
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, tt.path, nil))
+			if got != tt.want {
+				t.Errorf("transactionName = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
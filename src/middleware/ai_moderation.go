@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errContentFlagged = errors.New("the prompt was flagged by content moderation")
+
+// ModerationScore is a classifier's confidence that text belongs to Category.
+type ModerationScore struct {
+	Category string
+	Score    float64
+}
+
+// ModerationClassifier scores a prompt against moderation categories.
+type ModerationClassifier interface {
+	Classify(ctx context.Context, text string) ([]ModerationScore, error)
+}
+
+// ModerationOptions configures AIModerationMiddleware.
+type ModerationOptions struct {
+	// Thresholds maps categories to the score above which a prompt is
+	// blocked. Categories not listed use DefaultThreshold, or are ignored
+	// when it is zero.
+	Thresholds       map[string]float64
+	DefaultThreshold float64
+	// AllowTenants and AllowRoutes (route templates) skip moderation.
+	AllowTenants []string
+	AllowRoutes  []string
+	// Timeout bounds the classifier call. Defaults to 500ms. A classifier
+	// that fails or times out lets the request through.
+	Timeout time.Duration
+}
+
+// AIModerationMiddleware screens prompts with classifier before they reach
+// the model. Prompts scoring above a category threshold are rejected with
+// 422 listing the flagged categories, and tagged ai_moderation=flagged.
+func AIModerationMiddleware(classifier ModerationClassifier, opts ModerationOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if opts.bypassed(c) {
+			SetAITag(c, "ai_moderation", "bypassed")
+			audit(c, AuditEvent{Type: AuditModeration, Decision: AuditBypass, Model: DefaultModelResolver(c)})
+			c.Next()
+			return
+		}
+
+		req, err := parseCompletionRequest(c)
+		if err != nil {
+			// Unparseable bodies are left for validation to reject.
+			c.Next()
+			return
+		}
+
+		flagged, err := moderate(c.Request.Context(), classifier, opts, req.promptText())
+		if err != nil {
+			_ = c.Error(err)
+			SetAITag(c, "ai_moderation", "error")
+			c.Next()
+			return
+		}
+		if len(flagged) == 0 {
+			SetAITag(c, "ai_moderation", "passed")
+			c.Next()
+			return
+		}
+
+		SetAITag(c, "ai_moderation", "flagged")
+		audit(c, AuditEvent{Type: AuditModeration, Decision: AuditDeny, Model: DefaultModelResolver(c), Categories: flagged})
+		SetAITag(c, "ai_moderation_category", strings.Join(flagged, ","))
+		abortWithAPIError(c, http.StatusUnprocessableEntity, ErrTypeClient, errContentFlagged, contentFlaggedError(flagged))
+	}
+}
+
+func (opts *ModerationOptions) bypassed(c *gin.Context) bool {
+	return slices.Contains(opts.AllowRoutes, c.FullPath()) ||
+		slices.Contains(opts.AllowTenants, c.GetString(ContextKeyTenant))
+}
+
+// moderate classifies text and returns the categories over their threshold.
+func moderate(ctx context.Context, classifier ModerationClassifier, opts ModerationOptions, text string) ([]string, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 500 * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	scores, err := classifier.Classify(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+
+	var flagged []string
+	for _, s := range scores {
+		threshold, ok := opts.Thresholds[s.Category]
+		if !ok {
+			if opts.DefaultThreshold <= 0 {
+				continue
+			}
+			threshold = opts.DefaultThreshold
+		}
+		if s.Score > threshold {
+			flagged = append(flagged, s.Category)
+		}
+	}
+	return flagged, nil
+}
+
+func contentFlaggedError(flagged []string) APIError {
+	code := "content_flagged"
+	return APIError{
+		Message: errContentFlagged.Error(),
+		Type:    APIErrorInvalidRequest,
+		Code:    &code,
+		Details: gin.H{"categories": flagged},
+	}
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import "time"
+
+// Option configures AIMetricsMiddleware.
+type Option func(*metricsConfig)
+
+type metricsConfig struct {
+	tokenExtractor TokenExtractor
+	modelResolver  ModelResolver
+	prom           *AIMetrics
+	latencyBudgets map[string]time.Duration
+	defaultBudget  time.Duration
+	sampleRate     float64
+	capture        *bodyCapture
+	tracer         Tracer
+	deadLetter     DeadLetterSink
+	scrub          *scrubber
+	tenantScrub    map[string]*scrubber
+}
+
+// newMetricsConfig applies opts over the defaults, which match the
+// behaviour of AIMetricsMiddleware without options.
+func newMetricsConfig(opts []Option) *metricsConfig {
+	cfg := &metricsConfig{
+		tokenExtractor: HeaderTokenExtractor,
+		modelResolver:  DefaultModelResolver,
+		sampleRate:     1,
+		tracer:         SentryTracer{},
+		scrub:          defaultScrubber,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// budgetFor returns the latency budget for a route template. Zero means the
+// route has no budget.
+func (cfg *metricsConfig) budgetFor(route string) time.Duration {
+	if budget, ok := cfg.latencyBudgets[route]; ok {
+		return budget
+	}
+	return cfg.defaultBudget
+}
+
+// WithTokenExtractor replaces the default header-based token extractor.
+func WithTokenExtractor(fn TokenExtractor) Option {
+	return func(cfg *metricsConfig) {
+		if fn != nil {
+			cfg.tokenExtractor = fn
+		}
+	}
+}
+
+// WithModelResolver replaces the default model resolver.
+func WithModelResolver(fn ModelResolver) Option {
+	return func(cfg *metricsConfig) {
+		if fn != nil {
+			cfg.modelResolver = fn
+		}
+	}
+}
+
+// WithLatencyBudget sets per-route latency budgets keyed by route template,
+// e.g. "/ai/chat/:id". Requests slower than their budget are tagged ai_slow.
+func WithLatencyBudget(budgets map[string]time.Duration) Option {
+	return func(cfg *metricsConfig) {
+		cfg.latencyBudgets = budgets
+	}
+}
+
+// WithDefaultLatencyBudget sets the budget for routes missing from
+// WithLatencyBudget. By default such routes are never flagged.
+func WithDefaultLatencyBudget(d time.Duration) Option {
+	return func(cfg *metricsConfig) {
+		cfg.defaultBudget = d
+	}
+}
+
+// WithSampleRate starts a Sentry span for only a fraction of requests, in
+// [0, 1]. Scope metrics are still recorded for every request, and failed
+// (5xx) requests always get a span. A sampled flag in an incoming
+// sentry-trace header takes precedence, and the decision replaces the SDK's
+// TracesSampleRate.
+func WithSampleRate(rate float64) Option {
+	return func(cfg *metricsConfig) {
+		cfg.sampleRate = rate
+	}
+}
+
+// WithTracer selects the tracing backend. The default is SentryTracer.
+func WithTracer(t Tracer) Option {
+	return func(cfg *metricsConfig) {
+		if t != nil {
+			cfg.tracer = t
+		}
+	}
+}
+
+// WithPrometheus also records duration and status into m. AIMetrics.Middleware
+// is a shorthand for passing it.
+func WithPrometheus(m *AIMetrics) Option {
+	return func(cfg *metricsConfig) {
+		cfg.prom = m
+	}
+}
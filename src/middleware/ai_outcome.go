@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error type markers for c.Errors. Handlers mark the cause of a failure so
+// the outcome tag can tell provider failures from client mistakes:
+//
+//	c.Error(err).SetType(middleware.ErrTypeUpstream)
+const (
+	ErrTypeUpstream gin.ErrorType = 1 << 8
+	ErrTypeClient   gin.ErrorType = 1 << 9
+	ErrTypeTimeout  gin.ErrorType = 1 << 10
+)
+
+// Values of the ai_outcome tag.
+const (
+	OutcomeOK              = "ok"
+	OutcomeClientError     = "client_error"
+	OutcomeUpstreamError   = "upstream_error"
+	OutcomeTimeout         = "timeout"
+	OutcomeClientTimeout   = "client_timeout"
+	OutcomeValidationError = "validation_error"
+	OutcomePartialFailure  = "partial_failure"
+	OutcomeInputTooLarge   = "input_too_large"
+	OutcomeServedStale     = "served_stale"
+	// OutcomeClientDisconnected marks requests whose client went away
+	// before the handler finished. They are not failures of ours.
+	OutcomeClientDisconnected = "client_disconnected"
+	// OutcomeOverloaded marks requests rejected for lack of capacity. They
+	// say nothing about the provider, so breakers and fallback ignore them.
+	OutcomeOverloaded = "overloaded"
+	// OutcomeInternalError marks panics recovered by AIRecoveryMiddleware:
+	// our own failures, kept apart from the provider's.
+	OutcomeInternalError = "internal_error"
+)
+
+// statusClientClosedRequest is recorded for disconnected clients, after
+// nginx's 499, so they stay out of the 5xx error rate.
+const statusClientClosedRequest = 499
+
+// SetAIOutcome overrides the ai_outcome that AIMetricsMiddleware would
+// derive from the response, for failures it cannot tell apart by itself.
+func SetAIOutcome(c *gin.Context, outcome string) {
+	c.Set(ContextKeyOutcome, outcome)
+}
+
+// classifyOutcome maps a finished request to an ai_outcome value. An outcome
+// set with SetAIOutcome wins, then a client disconnect, then typed errors,
+// then the status code; unmarked 5xx count as upstream failures.
+func classifyOutcome(c *gin.Context, status int) string {
+	if outcome := c.GetString(ContextKeyOutcome); outcome != "" {
+		return outcome
+	}
+	switch {
+	case clientDisconnected(c):
+		return OutcomeClientDisconnected
+	case len(c.Errors.ByType(ErrTypeOverload)) > 0:
+		return OutcomeOverloaded
+	case len(c.Errors.ByType(ErrTypeTimeout)) > 0,
+		errors.Is(c.Request.Context().Err(), context.DeadlineExceeded),
+		status == http.StatusGatewayTimeout:
+		if c.GetBool(ContextKeyClientDeadline) {
+			return OutcomeClientTimeout
+		}
+		return OutcomeTimeout
+	case len(c.Errors.ByType(ErrTypeUpstream)) > 0:
+		return OutcomeUpstreamError
+	case len(c.Errors.ByType(ErrTypeClient)) > 0:
+		return OutcomeClientError
+	case status >= http.StatusInternalServerError:
+		return OutcomeUpstreamError
+	case status >= http.StatusBadRequest:
+		return OutcomeClientError
+	}
+	return OutcomeOK
+}
+
+// clientDisconnected reports whether the request context was cancelled,
+// which net/http does when the client closes the connection. Deadlines
+// expire with DeadlineExceeded instead, so they do not count.
+func clientDisconnected(c *gin.Context) bool {
+	return errors.Is(c.Request.Context().Err(), context.Canceled)
+}
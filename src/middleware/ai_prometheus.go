@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unmatchedRoute labels requests that did not match a route, so 404 scans
+// cannot create a series per path.
+const unmatchedRoute = "unmatched"
+
+// AIMetrics holds the Prometheus collectors fed by AIMetricsMiddleware and,
+// once attached with ObserveLimiter, by concurrency limiters.
+type AIMetrics struct {
+	Duration *prometheus.HistogramVec
+	Requests *prometheus.CounterVec
+
+	InFlight   *prometheus.GaugeVec
+	QueueDepth *prometheus.GaugeVec
+	QueueWait  *prometheus.HistogramVec
+
+	gatherer prometheus.Gatherer
+}
+
+// NewAIMetrics creates the AI collectors and registers them with reg. A nil
+// reg uses the default Prometheus registry.
+func NewAIMetrics(reg prometheus.Registerer) *AIMetrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	m := &AIMetrics{
+		Duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ai_request_duration_seconds",
+			Help:    "Duration of AI requests by route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint"}),
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ai_responses_total",
+			Help: "AI responses by route and status code.",
+		}, []string{"endpoint", "status"}),
+		InFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ai_concurrency_in_flight",
+			Help: "Slots held in each concurrency limiter.",
+		}, []string{"limiter"}),
+		QueueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ai_concurrency_queue_depth",
+			Help: "Requests waiting for a slot in each concurrency limiter.",
+		}, []string{"limiter"}),
+		QueueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ai_concurrency_queue_wait_seconds",
+			Help:    "Time spent waiting for a concurrency limiter slot.",
+			Buckets: []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"limiter"}),
+		gatherer: prometheus.DefaultGatherer,
+	}
+	reg.MustRegister(m.Duration, m.Requests, m.InFlight, m.QueueDepth, m.QueueWait)
+
+	if g, ok := reg.(prometheus.Gatherer); ok {
+		m.gatherer = g
+	}
+	return m
+}
+
+// Middleware returns AIMetricsMiddleware with m attached as an extra sink.
+func (m *AIMetrics) Middleware(opts ...Option) gin.HandlerFunc {
+	return AIMetricsMiddleware(append(opts, WithPrometheus(m))...)
+}
+
+// ObserveLimiter exports the in-flight count, queue depth and queue wait of
+// l under the limiter label name. Call it before l starts serving.
+func (m *AIMetrics) ObserveLimiter(name string, l *ConcurrencyLimiter) {
+	l.gauges = &limiterGauges{
+		inFlight:   m.InFlight.WithLabelValues(name),
+		queueDepth: m.QueueDepth.WithLabelValues(name),
+		queueWait:  m.QueueWait.WithLabelValues(name),
+	}
+}
+
+// Handler serves the registered collectors for scraping at /metrics.
+func (m *AIMetrics) Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{}))
+}
+
+func (m *AIMetrics) observe(endpoint string, status int, duration time.Duration) {
+	m.Duration.WithLabelValues(endpoint).Observe(duration.Seconds())
+	m.Requests.WithLabelValues(endpoint, strconv.Itoa(status)).Inc()
+}
+
+// routeLabel returns the route template for c, never the raw path.
+func routeLabel(c *gin.Context) string {
+	if route := c.FullPath(); route != "" {
+		return route
+	}
+	return unmatchedRoute
+}
@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errQuotaExhausted = errors.New("monthly token quota exhausted")
+
+// defaultCompletionReserve is the completion tokens reserved per request
+// when QuotaOptions.CompletionReserve is unset.
+const defaultCompletionReserve = 1024
+
+// QuotaStore tracks each tenant's remaining token budget for the current
+// billing period. Both methods must be atomic per tenant.
+type QuotaStore interface {
+	// Reserve subtracts tokens if the tenant has at least that many left,
+	// and returns what is left either way.
+	Reserve(ctx context.Context, tenant string, tokens int64) (remaining int64, ok bool, err error)
+	// Debit subtracts tokens, which are negative to refund, and returns
+	// what is left.
+	Debit(ctx context.Context, tenant string, tokens int64) (int64, error)
+}
+
+// QuotaOptions configures AIQuotaMiddleware.
+type QuotaOptions struct {
+	// TokenExtractor reads the tokens a request used. Defaults to
+	// HeaderTokenExtractor; usage stored under ContextKeyTokens wins.
+	TokenExtractor TokenExtractor
+	// Tokenizer estimates the prompt tokens reserved before the request
+	// runs. Defaults to HeuristicTokenizer.
+	Tokenizer Tokenizer
+	// CompletionReserve is added to the prompt estimate for the
+	// completion. Defaults to 1024.
+	CompletionReserve int64
+}
+
+// AIQuotaMiddleware reserves an estimate of each request's tokens from the
+// tenant's budget before it runs, rejecting it with 402 when the budget
+// cannot cover it, and settles the reservation against the tokens used once
+// it completes. Reserving atomically keeps concurrent requests from
+// overshooting the budget by more than the amount they use beyond their
+// estimates. The tenant comes from AIAuthMiddleware; requests without one
+// pass through. The remaining budget is recorded as ai_quota_remaining.
+// Requests re-run by ReplayHandler are not checked, and canary probes,
+// idempotent replays and cache hits are refunded.
+func AIQuotaMiddleware(store QuotaStore, opts QuotaOptions) gin.HandlerFunc {
+	if opts.TokenExtractor == nil {
+		opts.TokenExtractor = HeaderTokenExtractor
+	}
+	if opts.Tokenizer == nil {
+		opts.Tokenizer = HeuristicTokenizer{}
+	}
+	if opts.CompletionReserve <= 0 {
+		opts.CompletionReserve = defaultCompletionReserve
+	}
+
+	return func(c *gin.Context) {
+		tenant := c.GetString(ContextKeyTenant)
+		if tenant == "" || isReplay(c) {
+			c.Next()
+			return
+		}
+
+		reserved := opts.estimate(c)
+		remaining, ok, err := store.Reserve(c.Request.Context(), tenant, reserved)
+		if err != nil {
+			// Fail open: a quota outage should not take the API down.
+			_ = c.Error(err)
+			audit(c, AuditEvent{Type: AuditQuotaCheck, Decision: AuditError, Reason: err.Error()})
+			c.Next()
+			return
+		}
+		if !ok {
+			audit(c, AuditEvent{Type: AuditQuotaCheck, Decision: AuditDeny, Tokens: reserved, Remaining: &remaining, Reason: "insufficient_quota"})
+			SetAIExtra(c, "ai_quota_remaining", remaining)
+			AbortWithAIError(c, http.StatusPaymentRequired, ErrTypeQuota, "insufficient_quota", errQuotaExhausted)
+			return
+		}
+		audit(c, AuditEvent{Type: AuditQuotaCheck, Decision: AuditAllow, Tokens: reserved, Remaining: &remaining})
+
+		// Deferred so a panicking handler does not keep the reservation.
+		defer func() {
+			var used int64
+			if billable(c) {
+				if usage, ok := resolveTokens(c, opts.TokenExtractor); ok {
+					used = int64(usage.Total())
+				}
+			}
+			remaining, err := store.Debit(context.WithoutCancel(c.Request.Context()), tenant, used-reserved)
+			if err != nil {
+				_ = c.Error(err)
+				audit(c, AuditEvent{Type: AuditQuotaDebit, Decision: AuditError, Tokens: used, Reason: err.Error()})
+				return
+			}
+			if used > 0 {
+				audit(c, AuditEvent{Type: AuditQuotaDebit, Decision: AuditAllow, Tokens: used, Remaining: &remaining})
+			}
+			SetAIExtra(c, "ai_quota_remaining", remaining)
+		}()
+
+		c.Next()
+	}
+}
+
+// estimate returns the tokens to reserve for c: the estimated prompt plus
+// the completion reserve.
+func (opts *QuotaOptions) estimate(c *gin.Context) int64 {
+	tokens := opts.CompletionReserve
+	if req, err := parseCompletionRequest(c); err == nil {
+		model := DefaultModelResolver(c)
+		if model == "" {
+			model = req.Model
+		}
+		tokens += int64(opts.Tokenizer.CountTokens(model, req.promptText()))
+	}
+	return tokens
+}
+
+// MemoryQuotaStore is an in-process QuotaStore with monthly allowances that
+// reset at the start of each UTC month.
+type MemoryQuotaStore struct {
+	mu         sync.Mutex
+	allowances map[string]int64
+	used       map[string]int64
+	period     string
+	now        func() time.Time
+}
+
+// NewMemoryQuotaStore creates a store with the monthly token allowance of
+// each tenant. Tenants without an allowance have no budget.
+func NewMemoryQuotaStore(allowances map[string]int64) *MemoryQuotaStore {
+	return &MemoryQuotaStore{
+		allowances: allowances,
+		used:       make(map[string]int64),
+		now:        time.Now,
+	}
+}
+
+func (s *MemoryQuotaStore) Reserve(_ context.Context, tenant string, tokens int64) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rollover()
+	remaining := s.allowances[tenant] - s.used[tenant]
+	if remaining < tokens {
+		return remaining, false, nil
+	}
+	s.used[tenant] += tokens
+	return remaining - tokens, true, nil
+}
+
+func (s *MemoryQuotaStore) Debit(_ context.Context, tenant string, tokens int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rollover()
+	// A refund of a reservation made last period must not carry over.
+	s.used[tenant] = max(s.used[tenant]+tokens, 0)
+	return s.allowances[tenant] - s.used[tenant], nil
+}
+
+// rollover resets usage when a new month starts. s.mu must be held.
+func (s *MemoryQuotaStore) rollover() {
+	period := s.now().UTC().Format("2006-01")
+	if period != s.period {
+		s.period = period
+		s.used = make(map[string]int64)
+	}
+}
@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderAPIKey is read for the tenant API key when no bearer token is sent.
+const HeaderAPIKey = "X-API-Key"
+
+// RateLimit is a token bucket refilled at Rate tokens per second holding at
+// most Burst tokens. A zero Rate disables limiting.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimiter stores bucket state. Allow takes one token from the bucket for
+// key, or reports how long until one is available.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit RateLimit) (ok bool, retryAfter time.Duration, err error)
+}
+
+// RateLimitOptions configures AIRateLimitMiddleware.
+type RateLimitOptions struct {
+	// Limiter holds the buckets. Defaults to an in-memory limiter.
+	Limiter RateLimiter
+	// Limits maps model names to their limit.
+	Limits map[string]RateLimit
+	// DefaultLimit applies to models missing from Limits.
+	DefaultLimit RateLimit
+	// ModelResolver picks the model being called. Defaults to
+	// DefaultModelResolver.
+	ModelResolver ModelResolver
+}
+
+// AIRateLimitMiddleware limits requests per API key and model. Requests over
+// the limit are aborted with 429 and a Retry-After header.
+func AIRateLimitMiddleware(opts RateLimitOptions) gin.HandlerFunc {
+	if opts.Limiter == nil {
+		opts.Limiter = NewMemoryRateLimiter()
+	}
+	if opts.ModelResolver == nil {
+		opts.ModelResolver = DefaultModelResolver
+	}
+
+	return func(c *gin.Context) {
+		model := opts.ModelResolver(c)
+		allowed, retryAfter, err := opts.allow(c.Request.Context(), apiKeyFromRequest(c.Request), model)
+		if err != nil {
+			// Fail open: a limiter outage should not take the API down.
+			_ = c.Error(err)
+			c.Next()
+			return
+		}
+		if !allowed {
+			SetAITag(c, "ai_rate_limited", "true")
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			AbortWithAIError(c, http.StatusTooManyRequests, ErrTypeRateLimit, "rate_limit_exceeded", errRateLimited)
+			return
+		}
+		c.Next()
+	}
+}
+
+// allow takes a token from the bucket of apiKey and model. Models without a
+// limit are always allowed.
+func (opts *RateLimitOptions) allow(ctx context.Context, apiKey, model string) (bool, time.Duration, error) {
+	limit, ok := opts.Limits[model]
+	if !ok {
+		limit = opts.DefaultLimit
+	}
+	if limit.Rate <= 0 {
+		return true, 0, nil
+	}
+	return opts.Limiter.Allow(ctx, apiKeyScoped(apiKey, model), limit)
+}
+
+// apiKeyFromRequest returns the bearer token, or the X-API-Key header.
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.Header.Get(HeaderAPIKey)
+}
+
+// apiKeyScoped prefixes suffix with a hash of the API key, so store keys are
+// per tenant and raw keys never reach a store.
+func apiKeyScoped(apiKey, suffix string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:8]) + ":" + suffix
+}
+
+// MemoryRateLimiter is an in-process RateLimiter for tests and single
+// instance deployments. Buckets that have refilled are swept once a minute,
+// since a full bucket behaves like a missing one; keys are client supplied,
+// so they would otherwise grow without bound.
+type MemoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will have refilled to its burst.
+	full time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+func (l *MemoryRateLimiter) Allow(_ context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.full = now.Add(time.Duration((burst - b.tokens) / limit.Rate * float64(time.Second)))
+		return true, 0, nil
+	}
+	wait := (1 - b.tokens) / limit.Rate
+	return false, time.Duration(wait * float64(time.Second)), nil
+}
+
+// sweep drops refilled buckets, at most once per memorySweepInterval. The
+// caller holds l.mu.
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < memorySweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
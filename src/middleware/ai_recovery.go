@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// Unexported context keys shared by AIMetricsMiddleware and
+// AIRecoveryMiddleware.
+const (
+	// contextKeyRecovery is true when AIRecoveryMiddleware is installed, so
+	// the metrics middleware leaves the span of a panicking request open.
+	contextKeyRecovery = "ai.recovery"
+	// contextKeyOpenSpan holds the Span left open by a panic.
+	contextKeyOpenSpan = "ai.open_span"
+)
+
+var errInternal = errors.New("the server had an error while processing your request")
+
+// AIRecoveryMiddleware recovers panics, captures them to Sentry with the
+// AI context of the request (model, tenant, request ID and the ai_* tags)
+// linked to its trace, finishes the request span as an error and answers
+// 500 with a generic OpenAI-style error; the panic value never reaches the
+// client. Panics get ai_outcome=internal_error. It must be registered before AIMetricsMiddleware, which then
+// leaves the span open for it.
+func AIRecoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(contextKeyRecovery, true)
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if isAbortHandler(rec) {
+				panic(rec)
+			}
+
+			reportPanic(c, rec)
+			if v, ok := c.Get(contextKeyOpenSpan); ok {
+				if span, ok := v.(Span); ok {
+					span = &scrubbedSpan{Span: span, s: scrubberFromContext(c.Request.Context())}
+					span.SetTag("ai_panic", "true")
+					span.SetTag("ai_outcome", OutcomeInternalError)
+					if model := c.GetString(ContextKeyModel); model != "" {
+						span.SetTag("ai_model", model)
+					}
+					span.SetExtra("ai_response_status", http.StatusInternalServerError)
+					span.SetLevel(SpanLevelError)
+					span.Finish()
+				}
+			}
+
+			SetAIOutcome(c, OutcomeInternalError)
+			if c.Writer.Written() {
+				// Mid-stream: the status is gone, only record the failure.
+				_ = c.Error(errInternal).SetType(gin.ErrorTypePrivate)
+				c.Abort()
+				return
+			}
+			AbortWithAIError(c, http.StatusInternalServerError, gin.ErrorTypePrivate, "internal_error", errInternal)
+		}()
+
+		c.Next()
+	}
+}
+
+// isAbortHandler reports whether rec is http.ErrAbortHandler, net/http's
+// signal to drop the connection rather than a bug.
+func isAbortHandler(rec any) bool {
+	err, ok := rec.(error)
+	return ok && errors.Is(err, http.ErrAbortHandler)
+}
+
+// reportPanic captures rec on the request's hub in a scope carrying the AI
+// context, filtered by the request's scrub policy, and the trace of the open
+// span.
+func reportPanic(c *gin.Context, rec any) {
+	ctx := c.Request.Context()
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		hub = sentry.CurrentHub().Clone()
+	}
+	scrub := scrubberFromContext(ctx)
+
+	hub.WithScope(func(scope *sentry.Scope) {
+		setTag := func(key, value string) {
+			if value, ok := scrub.tag(key, value); ok {
+				scope.SetTag(key, value)
+			}
+		}
+		scope.SetLevel(sentry.LevelFatal)
+		setTag("ai_endpoint", routeLabel(c))
+		if model := c.GetString(ContextKeyModel); model != "" {
+			setTag("ai_model", model)
+		}
+		if tenant := c.GetString(ContextKeyTenant); tenant != "" {
+			setTag("ai_tenant", tenant)
+		}
+		if id := RequestIDFromContext(c); id != "" {
+			setTag("request_id", id)
+		}
+		for key, value := range aiTags(c) {
+			setTag(key, value)
+		}
+		for key, value := range aiExtras(c) {
+			if value, ok := scrub.extra(key, value); ok {
+				scope.SetExtra(key, value)
+			}
+		}
+		if span := sentry.SpanFromContext(ctx); span != nil {
+			scope.SetContext("trace", sentry.Context{
+				"trace_id": span.TraceID.String(),
+				"span_id":  span.SpanID.String(),
+				"op":       span.Op,
+			})
+		}
+		hub.RecoverWithContext(ctx, rec)
+	})
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecoveredPanicMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := NewAIMetrics(prometheus.NewRegistry())
+	var outcome string
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Next()
+		outcome = c.GetString(ContextKeyOutcome)
+	})
+	r.Use(AIRecoveryMiddleware(), AIMetricsMiddleware(WithPrometheus(m)))
+	r.POST("/ai/chat", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ai/chat", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if got := testutil.ToFloat64(m.Requests.WithLabelValues("/ai/chat", "500")); got != 1 {
+		t.Errorf("ai_responses_total{status=500} = %v, want 1", got)
+	}
+	if outcome != OutcomeInternalError {
+		t.Errorf("ai_outcome = %q, want %q", outcome, OutcomeInternalError)
+	}
+}
@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderDebugToken carries the internal token that guards ReplayHandler.
+const HeaderDebugToken = "X-Debug-Token"
+
+// maxReplayBody caps the replayed response body returned to the engineer.
+const maxReplayBody = 64 << 10
+
+var (
+	errInvalidDebugToken   = errors.New("invalid debug token")
+	errDeadLetterExpired   = errors.New("dead letter is older than the replay retention window")
+	errDeadLetterTruncated = errors.New("dead letter body was truncated and cannot be replayed")
+)
+
+// ReplayOptions configures ReplayHandler.
+type ReplayOptions struct {
+	// Token is the internal token expected in X-Debug-Token. Required; an
+	// empty Token rejects every replay.
+	Token string
+	// Store holds the dead letters. Required.
+	Store DeadLetterStore
+	// Handler runs the replay, normally the gin engine, so it takes the
+	// real middleware chain. Required.
+	Handler http.Handler
+	// APIKey authenticates replays, since dead letters keep no credentials.
+	APIKey string
+	// Retention refuses letters older than this. Defaults to 7 days.
+	Retention time.Duration
+	// Timeout bounds each replay. Defaults to 60s.
+	Timeout time.Duration
+}
+
+// replayReport is the body served by ReplayHandler.
+type replayReport struct {
+	ID       string         `json:"id"`
+	Original replayOriginal `json:"original"`
+	Replay   replayResult   `json:"replay"`
+	Diff     replayDiff     `json:"diff"`
+}
+
+type replayOriginal struct {
+	Time          time.Time `json:"time"`
+	Model         string    `json:"model,omitempty"`
+	Outcome       string    `json:"outcome"`
+	BytesStreamed int       `json:"bytes_streamed"`
+	Error         string    `json:"error,omitempty"`
+}
+
+type replayResult struct {
+	Status        int    `json:"status"`
+	Model         string `json:"model,omitempty"`
+	Outcome       string `json:"outcome,omitempty"`
+	Bytes         int    `json:"bytes"`
+	DurationMs    int64  `json:"duration_ms"`
+	Body          string `json:"body,omitempty"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+}
+
+type replayDiff struct {
+	// Fixed is true when the replay succeeded where the original failed.
+	Fixed        bool `json:"fixed"`
+	ModelChanged bool `json:"model_changed"`
+	// BytesDelta is the replay's body size minus what the original
+	// streamed before failing.
+	BytesDelta int `json:"bytes_delta"`
+}
+
+// ReplayHandler serves POST /ai/debug/replay/:id. It loads the dead letter
+// id from opts.Store, re-runs it through opts.Handler and answers with the
+// new result next to the original failure. Replays are tagged
+// ai_replay=true and skip quota, usage billing and the Prometheus metrics;
+// the original client is never contacted.
+func ReplayHandler(opts ReplayOptions) gin.HandlerFunc {
+	if opts.Retention <= 0 {
+		opts.Retention = 7 * 24 * time.Hour
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 60 * time.Second
+	}
+
+	return func(c *gin.Context) {
+		if !validInternalToken(c.GetHeader(HeaderDebugToken), opts.Token) {
+			AbortWithAIError(c, http.StatusUnauthorized, ErrTypeAuth, "invalid_debug_token", errInvalidDebugToken)
+			return
+		}
+		SetAITag(c, "ai_replay", "true")
+
+		id := c.Param("id")
+		letter, err := opts.Store.Load(c.Request.Context(), id)
+		switch {
+		case errors.Is(err, ErrDeadLetterNotFound):
+			AbortWithAIError(c, http.StatusNotFound, ErrTypeClient, "dead_letter_not_found", err)
+			return
+		case err != nil:
+			_ = c.Error(err)
+			AbortWithAIError(c, http.StatusInternalServerError, gin.ErrorTypePrivate, "", errors.New("dead letter store unavailable"))
+			return
+		case time.Since(letter.Time) > opts.Retention:
+			AbortWithAIError(c, http.StatusGone, ErrTypeClient, "dead_letter_expired", errDeadLetterExpired)
+			return
+		case letter.BodyTruncated:
+			AbortWithAIError(c, http.StatusUnprocessableEntity, ErrTypeClient, "dead_letter_truncated", errDeadLetterTruncated)
+			return
+		}
+		SetAITag(c, "ai_replay_of", letter.ID)
+
+		report, err := runReplay(c.Request.Context(), opts, letter)
+		if err != nil {
+			AbortWithAIError(c, http.StatusInternalServerError, gin.ErrorTypePrivate, "", fmt.Errorf("replay failed: %w", err))
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+func runReplay(ctx context.Context, opts ReplayOptions, letter DeadLetter) (*replayReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	probe := &syntheticRequest{replay: true}
+	ctx = context.WithValue(ctx, syntheticKey{}, probe)
+
+	req, err := http.NewRequestWithContext(ctx, letter.Method, letter.Path, bytes.NewReader(letter.Body))
+	if err != nil {
+		return nil, err
+	}
+	// Stores written before a header joined secretHeaders may still hold it.
+	req.Header = withoutSecretHeaders(letter.Header)
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	// The original trace and request ID belong to the failed request.
+	req.Header.Del(HeaderRequestID)
+	for key, values := range TraceHeadersFromContext(ctx) {
+		req.Header[key] = values
+	}
+	if opts.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.APIKey)
+	}
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	opts.Handler.ServeHTTP(rec, req)
+
+	body := rec.Body.Bytes()
+	result := replayResult{
+		Status:     rec.Code,
+		Model:      probe.model,
+		Outcome:    probe.outcome,
+		Bytes:      len(body),
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if len(body) > maxReplayBody {
+		body, result.BodyTruncated = body[:maxReplayBody], true
+	}
+	result.Body = string(body)
+
+	return &replayReport{
+		ID: letter.ID,
+		Original: replayOriginal{
+			Time:          letter.Time,
+			Model:         letter.Model,
+			Outcome:       OutcomePartialFailure,
+			BytesStreamed: letter.BytesStreamed,
+			Error:         letter.Error,
+		},
+		Replay: result,
+		Diff: replayDiff{
+			Fixed:        result.Outcome == OutcomeOK || (result.Outcome == "" && rec.Code < http.StatusBadRequest),
+			ModelChanged: result.Model != "" && result.Model != letter.Model,
+			BytesDelta:   result.Bytes - letter.BytesStreamed,
+		},
+	}, nil
+}
@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// completionRequest is the subset of an OpenAI-style completion or chat
+// request that the middlewares inspect.
+type completionRequest struct {
+	Model       string              `json:"model"`
+	Prompt      string              `json:"prompt"`
+	Messages    []completionMessage `json:"messages"`
+	Temperature *float64            `json:"temperature"`
+}
+
+type completionMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// text returns the message content, joining the text parts of multi-part
+// content.
+func (m completionMessage) text() string {
+	var s string
+	if err := json.Unmarshal(m.Content, &s); err == nil {
+		return s
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(m.Content, &parts); err != nil {
+		return ""
+	}
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// promptText returns the whole prompt: the prompt field or every message,
+// one per line with its role.
+func (r *completionRequest) promptText() string {
+	if len(r.Messages) == 0 {
+		return r.Prompt
+	}
+	var b strings.Builder
+	for i, m := range r.Messages {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(m.Role)
+		b.WriteString(": ")
+		b.WriteString(m.text())
+	}
+	return b.String()
+}
+
+// DefaultMaxBodyBytes caps the request bodies read by the middlewares, so
+// no body is buffered past it whichever middleware reads it first.
+const DefaultMaxBodyBytes int64 = 10 << 20
+
+// contextKeyBodyErr holds the error of the first failed body read, so later
+// readers see it rather than a half-consumed body.
+const contextKeyBodyErr = "ai.body_err"
+
+// requestBody reads the request body and puts it back so the handler can
+// still read it. The bytes are kept under gin.BodyBytesKey, the key used by
+// c.ShouldBindBodyWith, so the body is read from the client only once.
+// Bodies over DefaultMaxBodyBytes fail with *http.MaxBytesError.
+func requestBody(c *gin.Context) ([]byte, error) {
+	return readBody(c, DefaultMaxBodyBytes)
+}
+
+// readBody is requestBody with a limit of maxBytes. A body already read
+// under a larger limit fails if it is over maxBytes.
+func readBody(c *gin.Context, maxBytes int64) ([]byte, error) {
+	if cached, ok := c.Get(gin.BodyBytesKey); ok {
+		if body, ok := cached.([]byte); ok {
+			if int64(len(body)) > maxBytes {
+				return nil, &http.MaxBytesError{Limit: maxBytes}
+			}
+			return body, nil
+		}
+	}
+	if v, ok := c.Get(contextKeyBodyErr); ok {
+		return nil, v.(error)
+	}
+	if c.Request.Body == nil {
+		return nil, nil
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.Set(contextKeyBodyErr, err)
+		return nil, err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Set(gin.BodyBytesKey, body)
+	return body, nil
+}
+
+// parseCompletionRequest decodes the request body as a completion request.
+func parseCompletionRequest(c *gin.Context) (*completionRequest, error) {
+	body, err := requestBody(c)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCompletionRequest(body)
+}
+
+func decodeCompletionRequest(body []byte) (*completionRequest, error) {
+	var req completionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
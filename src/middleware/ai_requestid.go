@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"encoding/hex"
+	"math/rand"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderRequestID carries the request ID in both directions.
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLen bounds client-supplied IDs, which end up in logs and tags.
+const maxRequestIDLen = 128
+
+// AIRequestIDMiddleware gives every request an ID: the client's X-Request-ID
+// when it is sane, otherwise a new UUID. The ID is stored under
+// ContextKeyRequestID, tagged request_id and echoed in the response, so
+// logs, the response and the Sentry event share it.
+func AIRequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(HeaderRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		c.Set(ContextKeyRequestID, id)
+		SetAITag(c, "request_id", id)
+		c.Header(HeaderRequestID, id)
+		c.Next()
+	}
+}
+
+// RequestIDFromContext returns the ID set by AIRequestIDMiddleware.
+func RequestIDFromContext(c *gin.Context) string {
+	return c.GetString(ContextKeyRequestID)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random version 4 UUID. IDs only need to be unique,
+// so the cheap math/rand source is used instead of crypto/rand.
+func newRequestID() string {
+	var b [16]byte
+	for i := 0; i < len(b); i += 8 {
+		v := rand.Uint64()
+		for j := 0; j < 8; j++ {
+			b[i+j] = byte(v >> (8 * j))
+		}
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], b[10:])
+	return string(s[:])
+}
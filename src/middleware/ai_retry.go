@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RetryOptions configures NewRetryTransport.
+type RetryOptions struct {
+	// MaxRetries is the number of retries after the first attempt.
+	// Defaults to 2.
+	MaxRetries int
+	// BaseDelay is the backoff before the first retry; it doubles for each
+	// later one. Defaults to 100ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff. A provider Retry-After longer than this
+	// ends the retries. Defaults to 5s.
+	MaxDelay time.Duration
+}
+
+type retryStateKey struct{}
+
+// retryState ties provider calls made by a handler to the client request.
+// It is never modified once in a context; MarkIdempotent derives a new one.
+type retryState struct {
+	idempotent bool
+	// retries is shared with the states derived from this one, so
+	// ai_retries counts every call of the request.
+	retries *atomic.Int64
+	// committed reports whether the client response has started, after
+	// which a retried call could not be delivered.
+	committed func() bool
+}
+
+// MarkIdempotent returns a child of ctx whose calls are safe to retry. Calls
+// made with ctx itself are unaffected.
+func MarkIdempotent(ctx context.Context) context.Context {
+	state := &retryState{idempotent: true, retries: new(atomic.Int64)}
+	if parent, ok := ctx.Value(retryStateKey{}).(*retryState); ok {
+		state.retries = parent.retries
+		state.committed = parent.committed
+	}
+	return context.WithValue(ctx, retryStateKey{}, state)
+}
+
+// AIRetryMiddleware lets NewRetryTransport retry the provider calls of a
+// request: requests with an Idempotency-Key or an idempotent method are
+// marked idempotent, and calls stop being retried once the response to the
+// client has started. The number of retries is recorded as ai_retries.
+func AIRetryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := &retryState{
+			idempotent: isIdempotentRequest(c.Request),
+			retries:    new(atomic.Int64),
+			committed:  c.Writer.Written,
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), retryStateKey{}, state))
+
+		c.Next()
+
+		if n := state.retries.Load(); n > 0 {
+			SetAIExtra(c, "ai_retries", n)
+		}
+	}
+}
+
+func isIdempotentRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get(HeaderIdempotencyKey) != ""
+}
+
+// NewRetryTransport retries provider calls that fail with a transport error,
+// 429 or 5xx, using exponential backoff with jitter and honoring Retry-After.
+// Only calls whose context was marked idempotent (by AIRetryMiddleware or
+// MarkIdempotent) and whose body can be replayed are retried. A nil base
+// uses http.DefaultTransport.
+func NewRetryTransport(base http.RoundTripper, opts RetryOptions) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = 2
+	}
+	if opts.BaseDelay <= 0 {
+		opts.BaseDelay = 100 * time.Millisecond
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = 5 * time.Second
+	}
+	return &retryTransport{base: base, opts: opts}
+}
+
+type retryTransport struct {
+	base http.RoundTripper
+	opts RetryOptions
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	state, _ := r.Context().Value(retryStateKey{}).(*retryState)
+	if state == nil || !state.idempotent || (r.Body != nil && r.GetBody == nil) {
+		return t.base.RoundTrip(r)
+	}
+
+	for attempt := 0; ; attempt++ {
+		req := r
+		if attempt > 0 {
+			req = r.Clone(r.Context())
+			if r.GetBody != nil {
+				body, err := r.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= t.opts.MaxRetries || !retryable(r.Context(), resp, err) ||
+			(state.committed != nil && state.committed()) {
+			return resp, err
+		}
+
+		delay, ok := t.backoff(attempt, resp)
+		if !ok {
+			return resp, err
+		}
+		if resp != nil {
+			// Drain so the connection can be reused.
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			if err == nil {
+				err = r.Context().Err()
+			}
+			return nil, err
+		case <-timer.C:
+		}
+		state.retries.Add(1)
+	}
+}
+
+// backoff returns the wait before retry attempt+1. ok is false when the
+// provider asked us to wait longer than MaxDelay.
+func (t *retryTransport) backoff(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return wait, wait <= t.opts.MaxDelay
+		}
+	}
+	delay := t.opts.BaseDelay << attempt
+	if delay <= 0 || delay > t.opts.MaxDelay {
+		delay = t.opts.MaxDelay
+	}
+	// Jitter within [delay/2, delay) so clients do not retry in lockstep.
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1)), true
+}
+
+// retryable reports whether a call failed transiently.
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil && !errors.Is(err, ErrCircuitOpen)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header in seconds or HTTP-date form.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
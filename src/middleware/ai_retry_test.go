@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestMarkIdempotentScopesRetries(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var attempts atomic.Int64
+	upstream := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		attempts.Add(1)
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: r}, nil
+	})
+	client := &http.Client{Transport: NewRetryTransport(upstream, RetryOptions{MaxRetries: 1, BaseDelay: time.Millisecond})}
+
+	const marked = 4
+	var extras map[string]any
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Next()
+		v, _ := c.Get(ContextKeyExtras)
+		extras, _ = v.(map[string]any)
+	})
+	r.POST("/ai/chat", AIRetryMiddleware(), func(c *gin.Context) {
+		call := func(c *gin.Context, idempotent bool) {
+			ctx := c.Request.Context()
+			if idempotent {
+				ctx = MarkIdempotent(ctx)
+			}
+			req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://provider.test/v1/chat", nil)
+			if resp, err := client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < marked; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				call(c, true)
+			}()
+		}
+		wg.Wait()
+		// The POST itself is not idempotent, so this call is not retried.
+		call(c, false)
+		c.Status(http.StatusOK)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/ai/chat", nil))
+
+	if got, want := attempts.Load(), int64(marked*2+1); got != want {
+		t.Errorf("%d upstream attempts, want %d", got, want)
+	}
+	if got := extras["ai_retries"]; got != int64(marked) {
+		t.Errorf("ai_retries = %v, want %d", got, marked)
+	}
+}
@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultRouteName is the ai_route of requests that matched no rule.
+const defaultRouteName = "default"
+
+// RoutingRule sends matching requests to Model. Every condition that is set
+// must hold; a rule with no conditions matches everything.
+type RoutingRule struct {
+	Name  string `json:"name"`
+	Model string `json:"model"`
+
+	// Header must be present, and equal HeaderValue when that is set.
+	Header      string `json:"header,omitempty"`
+	HeaderValue string `json:"header_value,omitempty"`
+	// Tenants and Tiers match the key stored by AIAuthMiddleware.
+	Tenants []string `json:"tenants,omitempty"`
+	Tiers   []string `json:"tiers,omitempty"`
+	// MinPromptChars and MaxPromptChars bound the prompt length in
+	// characters, not bytes.
+	MinPromptChars int `json:"min_prompt_chars,omitempty"`
+	MaxPromptChars int `json:"max_prompt_chars,omitempty"`
+}
+
+// RoutingConfig is an ordered rule list; the first matching rule wins.
+type RoutingConfig struct {
+	Rules        []RoutingRule `json:"rules"`
+	DefaultModel string        `json:"default_model"`
+}
+
+// RoutingSource loads the current routing config.
+type RoutingSource func(ctx context.Context) (RoutingConfig, error)
+
+// FileRoutingSource reads a JSON RoutingConfig from path on every load.
+func FileRoutingSource(path string) RoutingSource {
+	return func(context.Context) (RoutingConfig, error) {
+		var cfg RoutingConfig
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		err = json.Unmarshal(data, &cfg)
+		return cfg, err
+	}
+}
+
+// ModelRouter holds the routing config. It is safe to update while serving.
+type ModelRouter struct {
+	cfg atomic.Pointer[RoutingConfig]
+}
+
+func NewModelRouter(cfg RoutingConfig) *ModelRouter {
+	r := &ModelRouter{}
+	r.Update(cfg)
+	return r
+}
+
+// Update replaces the routing config.
+func (r *ModelRouter) Update(cfg RoutingConfig) {
+	r.cfg.Store(&cfg)
+}
+
+// Watch reloads the config from src every interval until ctx is done. Failed
+// loads keep the current config and are passed to onError, if set.
+func (r *ModelRouter) Watch(ctx context.Context, src RoutingSource, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cfg, err := src(ctx)
+		if err != nil {
+			if onError != nil {
+				onError(err)
+			}
+			continue
+		}
+		r.Update(cfg)
+	}
+}
+
+// resolve returns the rule name and model for c. Rules routing to a model
+// the request's API key may not use are skipped, and a disallowed default
+// model leaves the requested one in place.
+func (r *ModelRouter) resolve(c *gin.Context) (string, string) {
+	cfg := r.cfg.Load()
+	for _, rule := range cfg.Rules {
+		if rule.Model != "" && !keyAllowsModel(c, rule.Model) {
+			continue
+		}
+		if rule.matches(c) {
+			return rule.Name, rule.Model
+		}
+	}
+	if cfg.DefaultModel != "" && !keyAllowsModel(c, cfg.DefaultModel) {
+		return defaultRouteName, ""
+	}
+	return defaultRouteName, cfg.DefaultModel
+}
+
+func (rule *RoutingRule) matches(c *gin.Context) bool {
+	if rule.Header != "" {
+		value := c.GetHeader(rule.Header)
+		if value == "" || (rule.HeaderValue != "" && value != rule.HeaderValue) {
+			return false
+		}
+	}
+	if len(rule.Tenants) > 0 || len(rule.Tiers) > 0 {
+		record, ok := APIKeyFromContext(c)
+		if !ok {
+			return false
+		}
+		if len(rule.Tenants) > 0 && !slices.Contains(rule.Tenants, record.Tenant) {
+			return false
+		}
+		if len(rule.Tiers) > 0 && !slices.Contains(rule.Tiers, record.Tier) {
+			return false
+		}
+	}
+	if rule.MinPromptChars > 0 || rule.MaxPromptChars > 0 {
+		req, err := parseCompletionRequest(c)
+		if err != nil {
+			return false
+		}
+		n := utf8.RuneCountInString(req.promptText())
+		if n < rule.MinPromptChars || (rule.MaxPromptChars > 0 && n > rule.MaxPromptChars) {
+			return false
+		}
+	}
+	return true
+}
+
+// AIRoutingMiddleware picks the backend model for each request from router
+// and stores it under ContextKeyModel, where handlers and
+// AIMetricsMiddleware read it. The matched rule is recorded as ai_route.
+func AIRoutingMiddleware(router *ModelRouter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route, model := router.resolve(c)
+		if model != "" {
+			c.Set(ContextKeyModel, model)
+		}
+		c.Set(ContextKeyRoute, route)
+		SetAITag(c, "ai_route", route)
+		c.Next()
+	}
+}
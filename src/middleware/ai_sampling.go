@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// sampleRequest decides whether r gets a full Sentry span. A sampled flag
+// in the sentry-trace header is the upstream's decision and wins; otherwise
+// requests that carry the header are sampled by trace ID, so every service in
+// the trace makes the same choice.
+func sampleRequest(r *http.Request, rate float64) bool {
+	header := r.Header.Get(sentry.SentryTraceHeader)
+	switch parentSampled(header) {
+	case sentry.SampledTrue:
+		return true
+	case sentry.SampledFalse:
+		return false
+	}
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	if traceID := traceIDFromHeader(header); traceID != "" {
+		h := fnv.New64a()
+		h.Write([]byte(traceID))
+		return float64(h.Sum64())/math.MaxUint64 < rate
+	}
+	return rand.Float64() < rate
+}
+
+// traceIDFromHeader returns the trace ID part of a sentry-trace header
+// ("<trace_id>-<span_id>[-<sampled>]").
+func traceIDFromHeader(header string) string {
+	traceID, _, _ := strings.Cut(header, "-")
+	return traceID
+}
+
+// parentSampled returns the sampled flag of a sentry-trace header, or
+// SampledUndefined when it has none.
+func parentSampled(header string) sentry.Sampled {
+	parts := strings.Split(header, "-")
+	if len(parts) < 3 {
+		return sentry.SampledUndefined
+	}
+	switch parts[2] {
+	case "1":
+		return sentry.SampledTrue
+	case "0":
+		return sentry.SampledFalse
+	}
+	return sentry.SampledUndefined
+}
@@ -0,0 +1,275 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// filteredValue replaces scrubbed values.
+const filteredValue = "[Filtered]"
+
+// ScrubPolicy allowlists what AIMetricsMiddleware may attach to Sentry.
+// Anything not listed is dropped. Entries ending in "*" match a prefix.
+type ScrubPolicy struct {
+	// Tags and Extras are the tag and extra keys that may be set.
+	Tags   []string
+	Extras []string
+	// Headers are the request headers attached, as ai_request_headers, to
+	// failed requests when body capture is on.
+	Headers []string
+	// BodyFields are the JSON fields kept in captured bodies, at any depth;
+	// other values become "[Filtered]". "*" keeps every field. Bodies that
+	// are not valid JSON, truncated ones included, are only kept with "*".
+	BodyFields []string
+}
+
+// DefaultScrubPolicy allows our own ai_* tags and extras and the structure
+// of completion bodies, but no prompt or completion text.
+func DefaultScrubPolicy() ScrubPolicy {
+	return ScrubPolicy{
+		Tags:    []string{"ai_*", "request_id"},
+		Extras:  []string{"ai_*"},
+		Headers: []string{"Content-Type", "Content-Length", "User-Agent", "Accept", HeaderRequestID},
+		BodyFields: []string{
+			"model", "stream", "temperature", "top_p", "n", "max_tokens", "stop",
+			"id", "object", "created", "index", "finish_reason",
+			"usage", "prompt_tokens", "completion_tokens", "total_tokens", "input_tokens", "output_tokens",
+			"error", "type", "code", "param",
+		},
+	}
+}
+
+// WithScrubPolicy replaces DefaultScrubPolicy for every tenant without its
+// own policy.
+func WithScrubPolicy(policy ScrubPolicy) Option {
+	return func(cfg *metricsConfig) {
+		cfg.scrub = newScrubber(policy)
+	}
+}
+
+// WithTenantScrubPolicy applies policy to tenant's requests instead of the
+// deployment policy, e.g. to lock regulated tenants down further.
+func WithTenantScrubPolicy(tenant string, policy ScrubPolicy) Option {
+	return func(cfg *metricsConfig) {
+		if cfg.tenantScrub == nil {
+			cfg.tenantScrub = make(map[string]*scrubber)
+		}
+		cfg.tenantScrub[tenant] = newScrubber(policy)
+	}
+}
+
+// defaultScrubber applies DefaultScrubPolicy outside AIMetricsMiddleware.
+var defaultScrubber = newScrubber(DefaultScrubPolicy())
+
+type scrubKey struct{}
+
+// withScrubber stores the scrubber lookup of a request in ctx. It is a func
+// because the tenant, and so the policy, is only known after auth.
+func withScrubber(ctx context.Context, lookup func() *scrubber) context.Context {
+	return context.WithValue(ctx, scrubKey{}, lookup)
+}
+
+// scrubberFromContext returns the scrubber for what is attached to Sentry
+// outside AIMetricsMiddleware, e.g. by AIRecoveryMiddleware and the breaker
+// transport, so they follow the same policy.
+func scrubberFromContext(ctx context.Context) *scrubber {
+	if lookup, ok := ctx.Value(scrubKey{}).(func() *scrubber); ok {
+		return lookup()
+	}
+	return defaultScrubber
+}
+
+// scrubFor returns the scrubber for tenant.
+func (cfg *metricsConfig) scrubFor(tenant string) *scrubber {
+	if s, ok := cfg.tenantScrub[tenant]; ok {
+		return s
+	}
+	return cfg.scrub
+}
+
+// Secrets are redacted even when allowlisted.
+var (
+	secretHeaders = headerSet(
+		"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+		HeaderAPIKey, HeaderCanaryToken, HeaderDebugToken,
+	)
+	secretFields = map[string]bool{
+		"authorization": true, "api_key": true, "apikey": true, "x-api-key": true,
+		"password": true, "secret": true, "client_secret": true,
+		"access_token": true, "refresh_token": true, "cookie": true,
+	}
+	secretPattern = regexp.MustCompile(`(?i)bearer\s+[a-z0-9._~+/=-]+|\bsk-[a-z0-9_-]{8,}`)
+)
+
+type scrubber struct {
+	tags       allowlist
+	extras     allowlist
+	headers    []string
+	bodyFields allowlist
+}
+
+func newScrubber(p ScrubPolicy) *scrubber {
+	headers := make([]string, 0, len(p.Headers))
+	for _, h := range p.Headers {
+		if h = http.CanonicalHeaderKey(h); !secretHeaders[h] {
+			headers = append(headers, h)
+		}
+	}
+	return &scrubber{
+		tags:       newAllowlist(p.Tags),
+		extras:     newAllowlist(p.Extras),
+		headers:    headers,
+		bodyFields: newAllowlist(p.BodyFields),
+	}
+}
+
+// requestHeaders returns the allowlisted headers of h.
+func (s *scrubber) requestHeaders(h http.Header) map[string]string {
+	out := make(map[string]string)
+	for _, key := range s.headers {
+		if v := h.Get(key); v != "" {
+			out[key] = scrubString(v)
+		}
+	}
+	return out
+}
+
+// body scrubs a rendered capture; truncated bodies are not valid JSON.
+func (s *scrubber) body(body string, truncated bool) string {
+	var v any
+	if truncated || json.Unmarshal([]byte(body), &v) != nil {
+		if s.bodyFields.all {
+			return scrubString(body)
+		}
+		return filteredValue
+	}
+	out, err := json.Marshal(s.scrubJSON("", v))
+	if err != nil {
+		return filteredValue
+	}
+	return string(out)
+}
+
+func (s *scrubber) scrubJSON(key string, v any) any {
+	if secretFields[strings.ToLower(key)] {
+		return filteredValue
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			v[k] = s.scrubJSON(k, child)
+		}
+		return v
+	case []any:
+		for i, child := range v {
+			v[i] = s.scrubJSON(key, child)
+		}
+		return v
+	}
+	if key == "" || !s.bodyFields.allows(key) {
+		return filteredValue
+	}
+	if str, ok := v.(string); ok {
+		return scrubString(str)
+	}
+	return v
+}
+
+// withoutSecretHeaders returns a copy of h without the secret headers, for
+// requests that are stored, such as dead letters.
+func withoutSecretHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for key := range out {
+		if secretHeaders[http.CanonicalHeaderKey(key)] {
+			delete(out, key)
+		}
+	}
+	return out
+}
+
+// scrubString redacts bearer tokens and API keys inside s.
+func scrubString(s string) string {
+	return secretPattern.ReplaceAllString(s, filteredValue)
+}
+
+// scrubbedSpan drops tags and extras outside the policy and redacts secrets
+// in the rest.
+type scrubbedSpan struct {
+	Span
+	s *scrubber
+}
+
+func (sp *scrubbedSpan) SetTag(key, value string) {
+	if value, ok := sp.s.tag(key, value); ok {
+		sp.Span.SetTag(key, value)
+	}
+}
+
+func (sp *scrubbedSpan) SetExtra(key string, value any) {
+	if value, ok := sp.s.extra(key, value); ok {
+		sp.Span.SetExtra(key, value)
+	}
+}
+
+// tag returns the scrubbed value of a tag, or false if it is not allowed.
+func (s *scrubber) tag(key, value string) (string, bool) {
+	if !s.tags.allows(key) {
+		return "", false
+	}
+	if secretFields[strings.ToLower(key)] {
+		return filteredValue, true
+	}
+	return scrubString(value), true
+}
+
+// extra returns the scrubbed value of an extra, or false if it is not
+// allowed.
+func (s *scrubber) extra(key string, value any) (any, bool) {
+	if !s.extras.allows(key) {
+		return nil, false
+	}
+	if secretFields[strings.ToLower(key)] {
+		return filteredValue, true
+	}
+	if str, ok := value.(string); ok {
+		return scrubString(str), true
+	}
+	return value, true
+}
+
+// allowlist matches keys exactly or, for entries ending in "*", by prefix.
+type allowlist struct {
+	all      bool
+	exact    map[string]bool
+	prefixes []string
+}
+
+func newAllowlist(entries []string) allowlist {
+	l := allowlist{exact: make(map[string]bool)}
+	for _, e := range entries {
+		switch {
+		case e == "*":
+			l.all = true
+		case strings.HasSuffix(e, "*"):
+			l.prefixes = append(l.prefixes, strings.TrimSuffix(e, "*"))
+		default:
+			l.exact[e] = true
+		}
+	}
+	return l
+}
+
+func (l allowlist) allows(key string) bool {
+	if l.all || l.exact[key] {
+		return true
+	}
+	for _, p := range l.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
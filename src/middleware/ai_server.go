@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Server wraps an http.Server so deploys drain in-flight AI requests instead
+// of killing long generations.
+type Server struct {
+	srv     *http.Server
+	limiter *ConcurrencyLimiter
+
+	// FlushTimeout bounds the final sentry.Flush. Defaults to 2s.
+	FlushTimeout time.Duration
+	// PollInterval is how often Shutdown checks the in-flight count.
+	// Defaults to 100ms.
+	PollInterval time.Duration
+}
+
+// NewServer wraps srv. limiter, if set, is the limiter behind
+// AIConcurrencyMiddleware; Shutdown waits for its in-flight count to reach
+// zero, which also covers hijacked and streamed connections that
+// http.Server.Shutdown does not track.
+func NewServer(srv *http.Server, limiter *ConcurrencyLimiter) *Server {
+	return &Server{
+		srv:          srv,
+		limiter:      limiter,
+		FlushTimeout: 2 * time.Second,
+		PollInterval: 100 * time.Millisecond,
+	}
+}
+
+// ListenAndServe serves until Shutdown is called. It returns nil after a
+// graceful shutdown.
+func (s *Server) ListenAndServe() error {
+	if err := s.srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting requests and waits for in-flight ones until ctx
+// is done, then force-closes the remaining connections. Buffered Sentry
+// events are flushed before it returns.
+func (s *Server) Shutdown(ctx context.Context) error {
+	defer sentry.Flush(s.FlushTimeout)
+
+	s.srv.SetKeepAlivesEnabled(false)
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.srv.Shutdown(ctx)
+	}()
+
+	if err := s.drain(ctx); err != nil {
+		closeErr := s.srv.Close()
+		<-shutdownErr
+		return errors.Join(err, closeErr)
+	}
+	if err := <-shutdownErr; err != nil {
+		// Connections still open when ctx ran out.
+		return errors.Join(err, s.srv.Close())
+	}
+	return nil
+}
+
+// drain waits until no request holds a concurrency slot.
+func (s *Server) drain(ctx context.Context) error {
+	if s.limiter == nil {
+		return nil
+	}
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	for s.limiter.InFlight() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// ShutdownOnSignal calls Shutdown with the given timeout when the process
+// receives one of signals, SIGINT or SIGTERM (sent by orchestrators such as
+// Kubernetes) if none are given. The returned channel receives Shutdown's
+// result.
+func (s *Server) ShutdownOnSignal(timeout time.Duration, signals ...os.Signal) <-chan error {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	notify := make(chan os.Signal, 1)
+	signal.Notify(notify, signals...)
+
+	done := make(chan error, 1)
+	go func() {
+		<-notify
+		signal.Stop(notify)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	return done
+}
@@ -0,0 +1,225 @@
+package middleware
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errLoadShed = errors.New("server is overloaded, request shed")
+
+// ShedPriority orders requests for LoadShedder; lower priorities are shed
+// first.
+type ShedPriority int
+
+const (
+	PriorityFree ShedPriority = iota
+	PriorityFreeIdempotent
+	PriorityPaid
+	PriorityPaidIdempotent
+)
+
+func (p ShedPriority) String() string {
+	switch p {
+	case PriorityFree:
+		return "free"
+	case PriorityFreeIdempotent:
+		return "free_idempotent"
+	case PriorityPaid:
+		return "paid"
+	case PriorityPaidIdempotent:
+		return "paid_idempotent"
+	}
+	return strconv.Itoa(int(p))
+}
+
+// PriorityFunc returns the shedding priority of a request.
+type PriorityFunc func(c *gin.Context) ShedPriority
+
+// DefaultPriority ranks requests by the tier of the key stored by
+// AIAuthMiddleware, then by idempotency: free before paid, non-idempotent
+// before idempotent. Unauthenticated requests and the "free" tier count as
+// free.
+func DefaultPriority(c *gin.Context) ShedPriority {
+	paid := false
+	if record, ok := APIKeyFromContext(c); ok {
+		paid = record.Tier != "" && record.Tier != "free"
+	}
+	idempotent := isIdempotentRequest(c.Request)
+	switch {
+	case paid && idempotent:
+		return PriorityPaidIdempotent
+	case paid:
+		return PriorityPaid
+	case idempotent:
+		return PriorityFreeIdempotent
+	}
+	return PriorityFree
+}
+
+// LoadShedOptions configures NewLoadShedder. At least one of
+// LatencyThreshold and Limiter must be set for anything to be shed.
+type LoadShedOptions struct {
+	// LatencyThreshold is the p99 latency, over Window, above which the
+	// server counts as overloaded.
+	LatencyThreshold time.Duration
+	// Window is the sliding window for the p99. Defaults to 30s.
+	Window time.Duration
+	// MinSamples is the number of requests in Window below which latency
+	// is ignored. Defaults to 50.
+	MinSamples int
+	// Limiter, if set, also counts the server as overloaded when its
+	// in-flight and queued requests reach Utilization of its max.
+	Limiter *ConcurrencyLimiter
+	// Utilization defaults to 0.9.
+	Utilization float64
+	// Priority ranks requests. Defaults to DefaultPriority.
+	Priority PriorityFunc
+	// RetryAfter is sent with shed requests. Defaults to 5s.
+	RetryAfter time.Duration
+}
+
+// shedStep is the extra pressure at which each next priority is shed.
+const shedStep = 0.25
+
+// maxLatencySamples bounds the memory of the latency window.
+const maxLatencySamples = 4096
+
+// LoadShedder rejects low-priority requests while the server is overloaded.
+// Pressure is the larger of p99 latency over LatencyThreshold and limiter
+// usage over Utilization; at pressure 1 free requests are shed, and each
+// further shedStep sheds the next priority. PriorityPaidIdempotent is never
+// shed, which is left to the concurrency limit.
+type LoadShedder struct {
+	opts LoadShedOptions
+
+	mu       sync.Mutex
+	samples  []latencySample
+	next     int
+	p99      time.Duration
+	computed time.Time
+}
+
+type latencySample struct {
+	at time.Time
+	d  time.Duration
+}
+
+func NewLoadShedder(opts LoadShedOptions) *LoadShedder {
+	if opts.Window <= 0 {
+		opts.Window = 30 * time.Second
+	}
+	if opts.MinSamples <= 0 {
+		opts.MinSamples = 50
+	}
+	if opts.Utilization <= 0 || opts.Utilization > 1 {
+		opts.Utilization = 0.9
+	}
+	if opts.Priority == nil {
+		opts.Priority = DefaultPriority
+	}
+	if opts.RetryAfter <= 0 {
+		opts.RetryAfter = 5 * time.Second
+	}
+	return &LoadShedder{opts: opts}
+}
+
+// AILoadShedMiddleware is a shorthand for NewLoadShedder(opts).Middleware().
+func AILoadShedMiddleware(opts LoadShedOptions) gin.HandlerFunc {
+	return NewLoadShedder(opts).Middleware()
+}
+
+// Pressure returns the current load relative to the thresholds; 1 or more
+// means overloaded.
+func (s *LoadShedder) Pressure() float64 {
+	var pressure float64
+	if s.opts.LatencyThreshold > 0 {
+		pressure = float64(s.P99()) / float64(s.opts.LatencyThreshold)
+	}
+	if l := s.opts.Limiter; l != nil && l.Max() > 0 {
+		usage := float64(l.InFlight()+l.Waiting()) / (float64(l.Max()) * s.opts.Utilization)
+		pressure = math.Max(pressure, usage)
+	}
+	return pressure
+}
+
+// P99 returns the p99 latency over the window, or zero with too few
+// samples. It is recomputed at most once a second.
+func (s *LoadShedder) P99() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.computed) < time.Second {
+		return s.p99
+	}
+	s.computed = now
+
+	cutoff := now.Add(-s.opts.Window)
+	durations := make([]time.Duration, 0, len(s.samples))
+	for _, sample := range s.samples {
+		if sample.at.After(cutoff) {
+			durations = append(durations, sample.d)
+		}
+	}
+	if len(durations) < s.opts.MinSamples {
+		s.p99 = 0
+		return 0
+	}
+	slices.Sort(durations)
+	s.p99 = durations[(len(durations)*99-1)/100]
+	return s.p99
+}
+
+func (s *LoadShedder) observe(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sample := latencySample{at: time.Now(), d: d}
+	if len(s.samples) < maxLatencySamples {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % maxLatencySamples
+}
+
+// sheds reports whether priority is shed at pressure.
+func sheds(priority ShedPriority, pressure float64) bool {
+	if pressure < 1 || priority >= PriorityPaidIdempotent {
+		return false
+	}
+	return pressure >= 1+float64(priority)*shedStep
+}
+
+// Middleware sheds requests by priority and records the latency of the
+// others. Register it after AIAuthMiddleware so DefaultPriority sees the
+// tenant's tier. Shed requests get 503 with Retry-After, ai_outcome
+// overloaded, and are tagged ai_shed=true and ai_shed_priority.
+func (s *LoadShedder) Middleware() gin.HandlerFunc {
+	retryAfter := strconv.Itoa(int(math.Ceil(s.opts.RetryAfter.Seconds())))
+
+	return func(c *gin.Context) {
+		priority := s.opts.Priority(c)
+		if pressure := s.Pressure(); sheds(priority, pressure) {
+			SetAITag(c, "ai_shed", "true")
+			SetAITag(c, "ai_shed_priority", priority.String())
+			SetAIExtra(c, "ai_shed_pressure", pressure)
+			c.Header("Retry-After", retryAfter)
+			AbortWithAIError(c, http.StatusServiceUnavailable, ErrTypeOverload, "server_overloaded", errLoadShed)
+			return
+		}
+
+		start := time.Now()
+		c.Next()
+		if !clientDisconnected(c) {
+			s.observe(time.Since(start))
+		}
+	}
+}
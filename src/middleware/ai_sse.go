@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// maxSSELine bounds the partial line kept between writes. Longer lines are
+// skipped; usage events are far smaller.
+const maxSSELine = 64 << 10
+
+var (
+	sseDataPrefix = []byte("data:")
+	usageMarker   = []byte(`"usage"`)
+)
+
+// sseUsageScanner watches an SSE stream for the usage event a provider sends
+// at the end of a generation, e.g.
+//
+//	data: {"usage":{"prompt_tokens":9,"completion_tokens":12}}
+//
+// Only the current partial line is buffered, never the stream.
+type sseUsageScanner struct {
+	line    []byte
+	skip    bool
+	onUsage func(TokenUsage)
+}
+
+func (s *sseUsageScanner) Write(p []byte) {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.buffer(p)
+			return
+		}
+		s.buffer(p[:i])
+		if !s.skip {
+			s.scanLine(s.line)
+		}
+		s.line = s.line[:0]
+		s.skip = false
+		p = p[i+1:]
+	}
+}
+
+func (s *sseUsageScanner) buffer(p []byte) {
+	if s.skip {
+		return
+	}
+	if len(s.line)+len(p) > maxSSELine {
+		s.line = s.line[:0]
+		s.skip = true
+		return
+	}
+	s.line = append(s.line, p...)
+}
+
+func (s *sseUsageScanner) scanLine(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	data, ok := bytes.CutPrefix(line, sseDataPrefix)
+	if !ok {
+		return
+	}
+	if usage, ok := parseUsage(data); ok {
+		s.onUsage(usage)
+	}
+}
+
+// parseUsage reads the usage object of a JSON response or event, in either
+// the prompt/completion or the input/output token naming.
+func parseUsage(data []byte) (TokenUsage, bool) {
+	if !bytes.Contains(data, usageMarker) {
+		return TokenUsage{}, false
+	}
+	var event struct {
+		Usage *struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			InputTokens      int `json:"input_tokens"`
+			OutputTokens     int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(data), &event); err != nil || event.Usage == nil {
+		return TokenUsage{}, false
+	}
+	u := event.Usage
+	return TokenUsage{
+		Prompt:     u.PromptTokens + u.InputTokens,
+		Completion: u.CompletionTokens + u.OutputTokens,
+	}, true
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderTimeoutMs lets a client set its own deadline, in milliseconds.
+const HeaderTimeoutMs = "X-AI-Timeout-Ms"
+
+// TimeoutOptions configures AITimeoutMiddlewareWithOptions.
+type TimeoutOptions struct {
+	// Default is the deadline of requests without a valid X-AI-Timeout-Ms.
+	Default time.Duration
+	// Min and Max clamp client-supplied deadlines. The header is ignored
+	// when Max is zero.
+	Min time.Duration
+	Max time.Duration
+}
+
+// AITimeoutMiddleware bounds each request to d. The deadline is set on
+// c.Request's context, so provider calls made with c.Request.Context() are
+// cancelled when it expires; no goroutine is left running the handler.
+// Requests that time out get a 504 unless the handler already responded.
+//
+// Register it before AIMetricsMiddleware so the metrics span runs inside the
+// deadline and records the timeout outcome.
+func AITimeoutMiddleware(d time.Duration) gin.HandlerFunc {
+	return AITimeoutMiddlewareWithOptions(TimeoutOptions{Default: d})
+}
+
+// AITimeoutMiddlewareWithOptions is AITimeoutMiddleware that also honors a
+// client deadline from X-AI-Timeout-Ms. The effective deadline is recorded
+// as ai_deadline_ms, and requests cut off by their own deadline are tagged
+// ai_outcome=client_timeout rather than timeout.
+func AITimeoutMiddlewareWithOptions(opts TimeoutOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		d, fromClient := opts.deadline(c.GetHeader(HeaderTimeoutMs))
+		SetAIExtra(c, "ai_deadline_ms", d.Milliseconds())
+		if fromClient {
+			c.Set(ContextKeyClientDeadline, true)
+		}
+
+		parent := c.Request.Context()
+		ctx, cancel := context.WithTimeout(parent, d)
+		defer func() {
+			cancel()
+			// Outer middlewares must not mistake the cancelled context for a
+			// client disconnect.
+			c.Request = c.Request.WithContext(parent)
+		}()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return
+		}
+		if c.Writer.Written() {
+			_ = c.Error(ctx.Err()).SetType(ErrTypeTimeout)
+			return
+		}
+		AbortWithAIError(c, http.StatusGatewayTimeout, ErrTypeTimeout, "timeout", errRequestTimeout)
+	}
+}
+
+// deadline returns the deadline for a request and whether the client chose
+// it. Unparseable or non-positive values fall back to the default.
+func (opts TimeoutOptions) deadline(header string) (time.Duration, bool) {
+	if opts.Max <= 0 || header == "" {
+		return opts.Default, false
+	}
+	ms, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || ms <= 0 {
+		return opts.Default, false
+	}
+	d := time.Duration(ms) * time.Millisecond
+	return min(max(d, opts.Min), opts.Max), true
+}
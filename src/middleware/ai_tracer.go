@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Tracer starts the request span recorded by AIMetricsMiddleware.
+type Tracer interface {
+	// StartSpan starts a span named name for r, continuing any trace found in
+	// its headers. The returned context carries the span.
+	StartSpan(r *http.Request, name string, opts SpanOptions) (context.Context, Span)
+	// StartChild starts a span named name under the span carried by ctx,
+	// sampled like it.
+	StartChild(ctx context.Context, name string) (context.Context, Span)
+}
+
+type tracerKey struct{}
+
+// withTracer stores the request's Tracer in ctx for the spans started below
+// the request span, e.g. by BatchHandler.
+func withTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// startChildSpan starts a span under the request span of ctx with the
+// request's Tracer, filtered by its scrub policy. Without AIMetricsMiddleware
+// it falls back to SentryTracer.
+func startChildSpan(ctx context.Context, name string) (context.Context, Span) {
+	t, ok := ctx.Value(tracerKey{}).(Tracer)
+	if !ok {
+		t = SentryTracer{}
+	}
+	ctx, span := t.StartChild(ctx, name)
+	return ctx, &scrubbedSpan{Span: span, s: scrubberFromContext(ctx)}
+}
+
+// SpanOptions controls how a Tracer starts a span.
+type SpanOptions struct {
+	// Start is the span start time.
+	Start time.Time
+	// Sampled is false when the span should propagate the trace but not be
+	// exported. It is the final decision: it overrides the parent's flag and
+	// the tracer's own sample rate.
+	Sampled bool
+}
+
+// Span is a request span. Keys are our standard ai_* names; each Tracer
+// maps them to its own conventions.
+type Span interface {
+	SetTag(key, value string)
+	SetExtra(key string, value any)
+	// SetLevel flags the span as a warning or an error.
+	SetLevel(level SpanLevel)
+	Finish()
+}
+
+// SpanLevel is the severity of a flagged span.
+type SpanLevel int
+
+const (
+	SpanLevelWarning SpanLevel = iota + 1
+	SpanLevelError
+)
+
+// SentryTracer records spans as Sentry transactions. Tags and extras are also
+// set on the Sentry scope so they attach to events captured during the
+// request.
+type SentryTracer struct{}
+
+func (SentryTracer) StartSpan(r *http.Request, name string, opts SpanOptions) (context.Context, Span) {
+	spanOpts := []sentry.SpanOption{
+		sentry.WithTransactionName(name),
+		sentry.ContinueFromRequest(r),
+	}
+	if opts.Sampled {
+		spanOpts = append(spanOpts, sentry.WithSpanSampled(sentry.SampledTrue))
+	} else {
+		spanOpts = append(spanOpts, sentry.WithSpanSampled(sentry.SampledFalse))
+	}
+	ctx := r.Context()
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		// A clone, so request tags and extras stay off the global scope.
+		hub = sentry.CurrentHub().Clone()
+		ctx = sentry.SetHubOnContext(ctx, hub)
+	}
+	span := sentry.StartSpan(ctx, "ai.request", spanOpts...)
+	if !opts.Start.IsZero() {
+		span.StartTime = opts.Start
+	}
+	return span.Context(), &sentrySpan{span: span, hub: hub}
+}
+
+// StartChild starts a child span. Its tags and extras stay on the span, off
+// the request's scope.
+func (SentryTracer) StartChild(ctx context.Context, name string) (context.Context, Span) {
+	span := sentry.StartSpan(ctx, name)
+	return span.Context(), &sentrySpan{span: span}
+}
+
+// sentrySpan is a Sentry span. hub is nil for child spans.
+type sentrySpan struct {
+	span *sentry.Span
+	hub  *sentry.Hub
+}
+
+func (s *sentrySpan) SetTag(key, value string) {
+	s.span.SetTag(key, value)
+	if s.hub != nil {
+		s.hub.ConfigureScope(func(scope *sentry.Scope) {
+			scope.SetTag(key, value)
+		})
+	}
+}
+
+func (s *sentrySpan) SetExtra(key string, value any) {
+	if s.hub == nil {
+		if status, ok := value.(int); ok && key == "ai_response_status" {
+			s.span.Status = sentry.HTTPtoSpanStatus(status)
+		}
+		s.span.SetData(key, fmt.Sprint(value))
+		return
+	}
+	s.hub.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetExtra(key, value)
+	})
+}
+
+func (s *sentrySpan) SetLevel(level SpanLevel) {
+	if level == SpanLevelError {
+		s.span.Status = sentry.SpanStatusInternalError
+	}
+	if s.hub == nil {
+		return
+	}
+	switch level {
+	case SpanLevelWarning:
+		s.hub.ConfigureScope(func(scope *sentry.Scope) {
+			scope.SetLevel(sentry.LevelWarning)
+		})
+	case SpanLevelError:
+		s.hub.ConfigureScope(func(scope *sentry.Scope) {
+			scope.SetLevel(sentry.LevelError)
+		})
+	}
+}
+
+func (s *sentrySpan) Finish() {
+	s.span.Finish()
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const otelInstrumentationName = "github.com/nawthtech/nawthtech-api-d1/middleware"
+
+// otelAttributeNames maps our standard keys to OpenTelemetry semantic
+// conventions. Other ai_* keys become ai.* attributes.
+var otelAttributeNames = map[string]string{
+	"ai_model":             "gen_ai.request.model",
+	"ai_tokens_prompt":     "gen_ai.usage.input_tokens",
+	"ai_tokens_completion": "gen_ai.usage.output_tokens",
+	"ai_response_status":   "http.response.status_code",
+	"ai_endpoint":          "http.route",
+	"ai_outcome":           "ai.outcome",
+}
+
+// OTelTracer records spans with OpenTelemetry. Incoming trace context is
+// extracted with the global propagator.
+type OTelTracer struct {
+	tracer trace.Tracer
+}
+
+// NewOTelTracer creates a Tracer from tp. A nil tp uses the global provider.
+func NewOTelTracer(tp trace.TracerProvider) *OTelTracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &OTelTracer{tracer: tp.Tracer(otelInstrumentationName)}
+}
+
+func (t *OTelTracer) StartSpan(r *http.Request, name string, opts SpanOptions) (context.Context, Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	tracer := t.tracer
+	if !opts.Sampled {
+		// Propagates the incoming span context without recording anything.
+		tracer = noop.NewTracerProvider().Tracer(otelInstrumentationName)
+	}
+	startOpts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindServer)}
+	if !opts.Start.IsZero() {
+		startOpts = append(startOpts, trace.WithTimestamp(opts.Start))
+	}
+	ctx, span := tracer.Start(ctx, name, startOpts...)
+	return ctx, &otelSpan{span: span}
+}
+
+func (t *OTelTracer) StartChild(ctx context.Context, name string) (context.Context, Span) {
+	tracer := t.tracer
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		tracer = noop.NewTracerProvider().Tracer(otelInstrumentationName)
+	}
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, &otelSpan{span: span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s *otelSpan) SetTag(key, value string) {
+	s.span.SetAttributes(attribute.String(otelAttributeName(key), value))
+}
+
+func (s *otelSpan) SetExtra(key string, value any) {
+	name := otelAttributeName(key)
+	var attr attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		attr = attribute.String(name, v)
+	case bool:
+		attr = attribute.Bool(name, v)
+	case int:
+		attr = attribute.Int(name, v)
+	case int64:
+		attr = attribute.Int64(name, v)
+	case float64:
+		attr = attribute.Float64(name, v)
+	default:
+		attr = attribute.String(name, fmt.Sprint(v))
+	}
+	s.span.SetAttributes(attr)
+}
+
+func (s *otelSpan) SetLevel(level SpanLevel) {
+	if level == SpanLevelError {
+		s.span.SetStatus(codes.Error, "")
+	}
+}
+
+func (s *otelSpan) Finish() {
+	s.span.End()
+}
+
+func otelAttributeName(key string) string {
+	if name, ok := otelAttributeNames[key]; ok {
+		return name
+	}
+	if rest, ok := strings.CutPrefix(key, "ai_"); ok {
+		return "ai." + rest
+	}
+	return key
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// TraceHeadersFromContext returns the sentry-trace and baggage headers for
+// the span in ctx, so downstream calls join the same trace. The header is
+// empty when ctx carries no span.
+func TraceHeadersFromContext(ctx context.Context) http.Header {
+	h := make(http.Header)
+	span := sentry.SpanFromContext(ctx)
+	if span == nil {
+		return h
+	}
+	h.Set(sentry.SentryTraceHeader, span.ToSentryTrace())
+	if baggage := span.ToBaggage(); baggage != "" {
+		h.Set(sentry.SentryBaggageHeader, baggage)
+	}
+	return h
+}
+
+// tracingTransport adds the trace headers of the request context to every
+// outgoing request.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+// NewTracingTransport wraps base so provider calls made with a request
+// context continue the trace started by AIMetricsMiddleware. A nil base uses
+// http.DefaultTransport.
+func NewTracingTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &tracingTransport{base: base}
+}
+
+func (t *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	headers := TraceHeadersFromContext(r.Context())
+	if len(headers) == 0 {
+		return t.base.RoundTrip(r)
+	}
+
+	// RoundTrippers must not modify the caller's request.
+	r = r.Clone(r.Context())
+	for key, values := range headers {
+		r.Header[key] = values
+	}
+	return t.base.RoundTrip(r)
+}
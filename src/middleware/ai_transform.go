@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Transformer maps one provider's response shape to our canonical one.
+type Transformer interface {
+	// TransformResponse rewrites a buffered JSON response body.
+	TransformResponse(body []byte) ([]byte, error)
+	// TransformEvent rewrites the data of one SSE event. A nil result drops
+	// the event.
+	TransformEvent(data []byte) ([]byte, error)
+}
+
+// ProviderResolver returns the provider that serves a request, or "".
+type ProviderResolver func(c *gin.Context) string
+
+// DefaultProviderResolver reads ContextKeyProvider.
+func DefaultProviderResolver(c *gin.Context) string {
+	return c.GetString(ContextKeyProvider)
+}
+
+var sseDone = []byte("[DONE]")
+
+// AITransformMiddleware rewrites successful JSON responses, and every event
+// of SSE responses, with the Transformer of the provider that served the
+// request, so clients see one shape whatever the backend. The provider is
+// resolved on the first write; without a transformer for it the response
+// passes through unchanged. Token usage is read from the provider's own
+// shape before rewriting and stored under ContextKeyTokens. A transformer
+// error sends the original bytes and is tagged ai_transform=error.
+// resolve defaults to DefaultProviderResolver.
+func AITransformMiddleware(transformers map[string]Transformer, resolve ProviderResolver) gin.HandlerFunc {
+	if resolve == nil {
+		resolve = DefaultProviderResolver
+	}
+
+	return func(c *gin.Context) {
+		w := &transformWriter{ResponseWriter: c.Writer, c: c}
+		w.lookup = func() Transformer { return transformers[resolve(c)] }
+		c.Writer = w
+		defer func() {
+			w.finish()
+			c.Writer = w.ResponseWriter
+		}()
+
+		c.Next()
+	}
+}
+
+type transformMode int
+
+const (
+	transformUndecided transformMode = iota
+	transformPassthrough
+	transformJSON
+	transformSSE
+)
+
+type transformWriter struct {
+	gin.ResponseWriter
+
+	c      *gin.Context
+	lookup func() Transformer
+	t      Transformer
+	mode   transformMode
+	size   int
+	// buf holds the whole body in JSON mode and the partial line in SSE mode.
+	buf bytes.Buffer
+}
+
+func (w *transformWriter) Write(b []byte) (int, error) {
+	w.decide()
+	w.size += len(b)
+	switch w.mode {
+	case transformJSON:
+		w.buf.Write(b)
+		return len(b), nil
+	case transformSSE:
+		w.buf.Write(b)
+		if err := w.writeLines(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *transformWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *transformWriter) Flush() {
+	if w.mode != transformJSON {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *transformWriter) Written() bool {
+	return w.mode != transformUndecided || w.ResponseWriter.Written()
+}
+
+func (w *transformWriter) Size() int {
+	if w.mode == transformJSON {
+		return w.size
+	}
+	return w.ResponseWriter.Size()
+}
+
+// decide picks the mode on the first write, once the provider, status and
+// content type are known.
+func (w *transformWriter) decide() {
+	if w.mode != transformUndecided {
+		return
+	}
+	w.mode = transformPassthrough
+	if w.t = w.lookup(); w.t == nil {
+		return
+	}
+	contentType := w.Header().Get("Content-Type")
+	switch {
+	case isEventStream(contentType):
+		w.mode = transformSSE
+	case strings.HasPrefix(contentType, "application/json") && w.Status() < http.StatusMultipleChoices:
+		w.mode = transformJSON
+		w.Header().Del("Content-Length")
+	}
+}
+
+// writeLines transforms and sends every complete line in buf.
+func (w *transformWriter) writeLines() error {
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			return nil
+		}
+		line := w.buf.Next(i + 1)
+		if _, err := w.ResponseWriter.Write(w.transformLine(line)); err != nil {
+			return err
+		}
+	}
+}
+
+// transformLine rewrites the payload of a data line; other lines, and the
+// [DONE] sentinel, are kept as is.
+func (w *transformWriter) transformLine(line []byte) []byte {
+	content := bytes.TrimRight(line, "\r\n")
+	data, ok := bytes.CutPrefix(content, sseDataPrefix)
+	if !ok {
+		return line
+	}
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, sseDone) {
+		return line
+	}
+	if usage, ok := parseUsage(data); ok {
+		w.c.Set(ContextKeyTokens, usage)
+	}
+
+	out, err := w.t.TransformEvent(data)
+	if err != nil {
+		w.transformFailed(err)
+		return line
+	}
+	if out == nil {
+		return nil
+	}
+	rewritten := make([]byte, 0, len(out)+len(line)-len(content)+6)
+	rewritten = append(rewritten, "data: "...)
+	rewritten = append(rewritten, out...)
+	return append(rewritten, line[len(content):]...)
+}
+
+// finish sends the transformed JSON body, or the last partial SSE line.
+func (w *transformWriter) finish() {
+	switch w.mode {
+	case transformSSE:
+		if w.buf.Len() > 0 {
+			_, _ = w.ResponseWriter.Write(w.transformLine(w.buf.Bytes()))
+		}
+	case transformJSON:
+		body := w.buf.Bytes()
+		if usage, ok := parseUsage(body); ok {
+			w.c.Set(ContextKeyTokens, usage)
+		}
+		out, err := w.t.TransformResponse(body)
+		if err != nil {
+			w.transformFailed(err)
+			out = body
+		}
+		_, _ = w.ResponseWriter.Write(out)
+	}
+}
+
+// transformFailed records err as an extra rather than with c.Error: the
+// original bytes are still delivered, so a failure after the stream was
+// committed must not count as a failed stream.
+func (w *transformWriter) transformFailed(err error) {
+	SetAITag(w.c, "ai_transform", "error")
+	SetAIExtra(w.c, "ai_transform_error", err.Error())
+}
@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderUsageSignature carries "sha256=<hex HMAC of the body>" on usage
+// webhooks when a secret is configured.
+const HeaderUsageSignature = "X-Usage-Signature"
+
+// UsageEvent is the body POSTed to the usage webhook.
+type UsageEvent struct {
+	RequestID        string    `json:"request_id,omitempty"`
+	Tenant           string    `json:"tenant,omitempty"`
+	Model            string    `json:"model,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	CostUSD          *float64  `json:"cost_usd,omitempty"`
+	Timestamp        time.Time `json:"timestamp"`
+}
+
+// UsageEmitterOptions configures NewUsageEmitter.
+type UsageEmitterOptions struct {
+	// URL is the webhook endpoint. Required.
+	URL string
+	// Secret, if set, signs every body in X-Usage-Signature.
+	Secret []byte
+	// Client defaults to a client with a 10s timeout.
+	Client *http.Client
+	// QueueSize bounds the events waiting to be sent; events beyond it are
+	// dropped. Defaults to 1000.
+	QueueSize int
+	// MaxRetries is the number of retries after a failed delivery.
+	// Defaults to 3.
+	MaxRetries int
+	// BaseDelay is the backoff before the first retry; it doubles for each
+	// later one. Defaults to 500ms.
+	BaseDelay time.Duration
+	// OnError, if set, is called with events that could not be delivered.
+	OnError func(UsageEvent, error)
+}
+
+// UsageEmitter delivers usage events to a webhook from a background
+// goroutine, so request handling never waits on the receiver.
+type UsageEmitter struct {
+	opts    UsageEmitterOptions
+	queue   chan UsageEvent
+	dropped atomic.Int64
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+var errUsageWebhookStatus = errors.New("usage webhook rejected the event")
+
+func NewUsageEmitter(opts UsageEmitterOptions) *UsageEmitter {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1000
+	}
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.BaseDelay <= 0 {
+		opts.BaseDelay = 500 * time.Millisecond
+	}
+	e := &UsageEmitter{
+		opts:  opts,
+		queue: make(chan UsageEvent, opts.QueueSize),
+		done:  make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Emit queues ev without blocking. It reports false, and counts a drop,
+// when the queue is full or the emitter is closed.
+func (e *UsageEmitter) Emit(ev UsageEvent) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if !e.closed {
+		select {
+		case e.queue <- ev:
+			return true
+		default:
+		}
+	}
+	e.dropped.Add(1)
+	return false
+}
+
+// Dropped returns the number of events dropped so far.
+func (e *UsageEmitter) Dropped() int64 {
+	return e.dropped.Load()
+}
+
+// Close stops accepting events and waits until the queued ones are
+// delivered or ctx is done.
+func (e *UsageEmitter) Close(ctx context.Context) error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Middleware emits a usage event after each request whose token usage is
+// known, except those that are not billable. It reads the values stored by
+// AIMetricsMiddleware and AICostMiddleware, so register it before both.
+func (e *UsageEmitter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if !billable(c) {
+			return
+		}
+		v, ok := c.Get(ContextKeyTokens)
+		if !ok {
+			return
+		}
+		usage, ok := v.(TokenUsage)
+		if !ok {
+			return
+		}
+		ev := UsageEvent{
+			RequestID:        RequestIDFromContext(c),
+			Tenant:           c.GetString(ContextKeyTenant),
+			Model:            DefaultModelResolver(c),
+			PromptTokens:     usage.Prompt,
+			CompletionTokens: usage.Completion,
+			TotalTokens:      usage.Total(),
+			Timestamp:        time.Now().UTC(),
+		}
+		if cost, ok := c.Get(ContextKeyCostUSD); ok {
+			if cost, ok := cost.(float64); ok {
+				ev.CostUSD = &cost
+			}
+		}
+		if !e.Emit(ev) {
+			SetAITag(c, "ai_usage_dropped", "true")
+		}
+	}
+}
+
+// billable reports whether c ran a new completion for the tenant. Canary
+// probes and replays are our own traffic, and idempotent replays and cache
+// hits repeat the X-AI-Tokens-* headers of a completion already billed.
+func billable(c *gin.Context) bool {
+	if syntheticFromContext(c.Request.Context()) != nil || c.GetBool(ContextKeyCanary) {
+		return false
+	}
+	h := c.Writer.Header()
+	if h.Get(HeaderIdempotentReplay) != "" {
+		return false
+	}
+	switch h.Get(HeaderAICache) {
+	case "hit", "stale":
+		return false
+	}
+	return true
+}
+
+func (e *UsageEmitter) run() {
+	defer close(e.done)
+	for ev := range e.queue {
+		if err := e.deliver(ev); err != nil && e.opts.OnError != nil {
+			e.opts.OnError(ev, err)
+		}
+	}
+}
+
+// deliver posts ev, retrying transport errors, 429 and 5xx with backoff.
+func (e *UsageEmitter) deliver(ev UsageEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		retry, err := e.post(body)
+		if err == nil || !retry || attempt >= e.opts.MaxRetries {
+			return err
+		}
+		time.Sleep(e.opts.BaseDelay << attempt)
+	}
+}
+
+// post sends one delivery attempt; retry reports whether a failure is
+// transient.
+func (e *UsageEmitter) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, e.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(e.opts.Secret) > 0 {
+		mac := hmac.New(sha256.New, e.opts.Secret)
+		mac.Write(body)
+		req.Header.Set(HeaderUsageSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := e.opts.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < http.StatusMultipleChoices {
+		return false, nil
+	}
+	err = fmt.Errorf("%w: status %d", errUsageWebhookStatus, resp.StatusCode)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError, err
+}
@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ChatCompletionSchema is the JSON schema of an OpenAI-style chat request.
+const ChatCompletionSchema = `{
+	"type": "object",
+	"required": ["model", "messages"],
+	"properties": {
+		"model": {"type": "string", "minLength": 1},
+		"messages": {
+			"type": "array",
+			"minItems": 1,
+			"items": {
+				"type": "object",
+				"required": ["role", "content"],
+				"properties": {"role": {"type": "string"}}
+			}
+		},
+		"temperature": {"type": "number", "minimum": 0, "maximum": 2},
+		"max_tokens": {"type": "integer", "minimum": 1}
+	}
+}`
+
+var errInvalidRequestBody = errors.New("request body does not match the schema")
+
+// FieldError describes one schema violation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// SchemaRegistry holds request schemas by route template, e.g. "/ai/chat".
+// Schemas can be registered while the server runs.
+type SchemaRegistry struct {
+	mu      sync.RWMutex
+	schemas map[string]*jsonschema.Schema
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{schemas: make(map[string]*jsonschema.Schema)}
+}
+
+// Register compiles schema and uses it for route, replacing any previous one.
+func (r *SchemaRegistry) Register(route, schema string) error {
+	compiler := jsonschema.NewCompiler()
+	url := "schema://" + route
+	if err := compiler.AddResource(url, bytes.NewReader([]byte(schema))); err != nil {
+		return fmt.Errorf("schema for %s: %w", route, err)
+	}
+	compiled, err := compiler.Compile(url)
+	if err != nil {
+		return fmt.Errorf("schema for %s: %w", route, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas[route] = compiled
+	return nil
+}
+
+// Load registers every schema in a JSON object mapping route templates to
+// schemas, such as a config file.
+func (r *SchemaRegistry) Load(src io.Reader) error {
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(src).Decode(&doc); err != nil {
+		return err
+	}
+	for route, schema := range doc {
+		if err := r.Register(route, string(schema)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SchemaRegistry) lookup(route string) *jsonschema.Schema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.schemas[route]
+}
+
+// AIValidationMiddleware validates request bodies against the schema
+// registered for the route before the handler runs. Invalid requests get 422
+// in the OpenAI error envelope with a details list of field errors, and are
+// tagged ai_outcome=validation_error. Routes without a schema pass through.
+func AIValidationMiddleware(registry *SchemaRegistry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		schema := registry.lookup(c.FullPath())
+		if schema == nil {
+			c.Next()
+			return
+		}
+
+		body, err := requestBody(c)
+		if abortBodyTooLarge(c, err) {
+			return
+		}
+		if err != nil {
+			AbortWithAIError(c, http.StatusBadRequest, ErrTypeClient, "invalid_body", err)
+			return
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var doc any
+		if err := dec.Decode(&doc); err != nil {
+			SetAIOutcome(c, OutcomeValidationError)
+			abortWithValidationErrors(c, []FieldError{{Field: "", Message: "body is not valid JSON"}})
+			return
+		}
+
+		var ve *jsonschema.ValidationError
+		if err := schema.Validate(doc); errors.As(err, &ve) {
+			SetAIOutcome(c, OutcomeValidationError)
+			abortWithValidationErrors(c, fieldErrors(ve))
+			return
+		} else if err != nil {
+			_ = c.Error(err)
+		}
+		c.Next()
+	}
+}
+
+func abortWithValidationErrors(c *gin.Context, fields []FieldError) {
+	apiErr := APIError{
+		Message: errInvalidRequestBody.Error(),
+		Type:    APIErrorInvalidRequest,
+		Details: fields,
+	}
+	if len(fields) > 0 && fields[0].Field != "" {
+		apiErr.Param = &fields[0].Field
+	}
+	abortWithAPIError(c, http.StatusUnprocessableEntity, ErrTypeClient, errInvalidRequestBody, apiErr)
+}
+
+// fieldErrors flattens ve into its leaf errors, which name the failing field.
+func fieldErrors(ve *jsonschema.ValidationError) []FieldError {
+	if len(ve.Causes) == 0 {
+		return []FieldError{{Field: ve.InstanceLocation, Message: ve.Message}}
+	}
+	var fields []FieldError
+	for _, cause := range ve.Causes {
+		fields = append(fields, fieldErrors(cause)...)
+	}
+	return fields
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// aiResponseWriter wraps the Gin writer to observe the response as it is
+// written. Embedding keeps Flush and Hijack working for streamed responses.
+type aiResponseWriter struct {
+	gin.ResponseWriter
+
+	firstWrite time.Time
+	flushed    bool
+	// committed is set once the status line and headers may have reached
+	// the client, after which the status can no longer change.
+	committed bool
+	// errCount, if set, reports len(c.Errors); it is sampled on commit to
+	// tell errors raised mid-stream from earlier ones.
+	errCount     func() int
+	errsAtCommit int
+	capture      *cappedBuffer
+	usage        *sseUsageScanner
+}
+
+var (
+	_ http.Flusher  = (*aiResponseWriter)(nil)
+	_ http.Hijacker = (*aiResponseWriter)(nil)
+)
+
+func newAIResponseWriter(w gin.ResponseWriter) *aiResponseWriter {
+	return &aiResponseWriter{ResponseWriter: w}
+}
+
+func (w *aiResponseWriter) Write(b []byte) (int, error) {
+	w.observe(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *aiResponseWriter) WriteString(s string) (int, error) {
+	w.observe([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *aiResponseWriter) WriteHeaderNow() {
+	w.markCommitted()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *aiResponseWriter) observe(b []byte) {
+	w.markFirstWrite()
+	w.markCommitted()
+	if w.capture != nil && !w.streaming() {
+		w.capture.Write(b)
+	}
+	if w.usage != nil && isEventStream(w.Header().Get("Content-Type")) {
+		w.usage.Write(b)
+	}
+}
+
+func (w *aiResponseWriter) Flush() {
+	w.flushed = true
+	w.markCommitted()
+	w.ResponseWriter.Flush()
+}
+
+// streaming reports whether the response is being streamed to the client,
+// either as an SSE stream or by explicit flushes.
+func (w *aiResponseWriter) streaming() bool {
+	return w.flushed || isEventStream(w.Header().Get("Content-Type"))
+}
+
+func (w *aiResponseWriter) markFirstWrite() {
+	if w.firstWrite.IsZero() {
+		w.firstWrite = time.Now()
+	}
+}
+
+func (w *aiResponseWriter) markCommitted() {
+	if !w.committed {
+		w.committed = true
+		if w.errCount != nil {
+			w.errsAtCommit = w.errCount()
+		}
+	}
+}
+
+// streamFailed reports whether the handler recorded an error after the
+// headers were committed, i.e. a failure the status code cannot show.
+func (w *aiResponseWriter) streamFailed() bool {
+	return w.committed && w.errCount != nil && w.errCount() > w.errsAtCommit
+}
+
+// timeToFirstByte returns the delay between start and the first body write,
+// or fallback when nothing was written.
+func (w *aiResponseWriter) timeToFirstByte(start time.Time, fallback time.Duration) time.Duration {
+	if w.firstWrite.IsZero() {
+		return fallback
+	}
+	return w.firstWrite.Sub(start)
+}